@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/dns/v1"
+)
+
+// Body of PUT /records/{name}/{type}. Name and type come from the path.
+type apiRecord struct {
+	Ttl           int64       `json:"ttl,omitempty"`
+	Rrdatas       []string    `json:"rrdatas"`
+	RoutingPolicy interface{} `json:"routingPolicy,omitempty"`
+}
+
+func requireToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	// Only let through requests with 'Authorization: Bearer <token>'.
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(data, '\n'))
+}
+
+func apiError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func parseRecordPath(dnsSpec *CloudDNSSpec, path string) (string, string, error) {
+	// /records/{name}/{type}, where name is relative to the zone or fully
+	// qualified, and "@" is the apex.
+	parts := strings.Split(strings.TrimPrefix(path, "/records/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("want /records/{name}/{type}")
+	}
+	name := qualifyName(parts[0], *dnsSpec.domain)
+	if !nameInZone(name, *dnsSpec.domain) {
+		return "", "", fmt.Errorf("%s is not in %s", name, *dnsSpec.domain)
+	}
+	return name, strings.ToUpper(parts[1]), nil
+}
+
+func buildRecordChange(cloud_rrs []*dns.ResourceRecordSet, want *dns.ResourceRecordSet, rtype string, name string) (*dns.Change, bool) {
+	// The change to make name/rtype be want, or go away if want is nil.
+	// Also returns whether it exists now.
+	var existing *dns.ResourceRecordSet
+	for _, c := range cloud_rrs {
+		if sameRrsetKey(c, &dns.ResourceRecordSet{Name: name, Type: rtype}) {
+			existing = c
+		}
+	}
+	if want != nil {
+		// Not pruning, so where the apex is doesn't matter.
+		return buildDnsChange(cloud_rrs, []*dns.ResourceRecordSet{want}, false, ""), existing != nil
+	}
+	if existing == nil {
+		return &dns.Change{}, false
+	}
+	return &dns.Change{Deletions: []*dns.ResourceRecordSet{existing}}, true
+}
+
+func registerApiHandlers(mux *http.ServeMux, dnsSpec *CloudDNSSpec, token string, trigger chan<- chan error) {
+	// Changes made through the API go in the journal as "api".
+	apiSpec := *dnsSpec
+	source := "api"
+	apiSpec.source = &source
+
+	mux.HandleFunc("/sync", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Buffered, so the sync loop doesn't get stuck if we've gone away.
+		done := make(chan error, 1)
+		select {
+		case trigger <- done:
+		case <-r.Context().Done():
+			return
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				apiError(w, http.StatusBadGateway, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"result": "synced"})
+		case <-r.Context().Done():
+		}
+	}))
+
+	mux.HandleFunc("/zone", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rrs, err := getResourceRecordSetsForZone(&apiSpec)
+		if err != nil {
+			apiError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rrsetsToZoneRecords(*apiSpec.domain, rrs))
+	}))
+
+	mux.HandleFunc("/records/", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		name, rtype, err := parseRecordPath(&apiSpec, r.URL.Path)
+		if err != nil {
+			apiError(w, http.StatusNotFound, err)
+			return
+		}
+
+		var want *dns.ResourceRecordSet
+		switch r.Method {
+		case http.MethodPut:
+			body := apiRecord{}
+			data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err == nil {
+				err = json.Unmarshal(data, &body)
+			}
+			if err == nil && len(body.Rrdatas) == 0 && body.RoutingPolicy == nil {
+				err = fmt.Errorf("no rrdatas")
+			}
+			if err == nil {
+				want, err = zoneRecordToRrset(&apiSpec, zoneRecord{
+					Name:          name,
+					Type:          rtype,
+					Ttl:           body.Ttl,
+					Rrdatas:       body.Rrdatas,
+					RoutingPolicy: body.RoutingPolicy,
+				})
+			}
+			if err != nil {
+				apiError(w, http.StatusBadRequest, err)
+				return
+			}
+		case http.MethodDelete:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Cloud DNS looks after these itself, as with zonefiles.
+		if rtype == "SOA" || (rtype == "NS" && normalizeName(name) == normalizeName(*apiSpec.domain)) {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("the %s record for %s belongs to Cloud DNS", rtype, name))
+			return
+		}
+
+		found := false
+		var change *dns.Change
+		err = syncCloudDns(&apiSpec, func() (*dns.Change, error) {
+			cloud_rrs, err := getResourceRecordSetsForZone(&apiSpec)
+			if err != nil {
+				return nil, err
+			}
+			change, found = buildRecordChange(cloud_rrs, want, rtype, name)
+			return change, nil
+		})
+		if err != nil {
+			log.Printf("API %s %s: %s", r.Method, r.URL.Path, err)
+			apiError(w, http.StatusBadGateway, err)
+			return
+		}
+		if want == nil && !found {
+			apiError(w, http.StatusNotFound, fmt.Errorf("no %s record for %s", rtype, name))
+			return
+		}
+		writeJSON(w, http.StatusOK, planJSONChanges(diffDnsChange(change)))
+	}))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/option"
+)
+
+// Just enough of Cloud DNS to list and change one zone's rrsets.
+type fakeCloudDns struct {
+	mu      sync.Mutex
+	rrs     []*dns.ResourceRecordSet
+	changes []*dns.Change
+	// How many times the whole zone was listed, rather than one name and type.
+	zoneLists int
+}
+
+func (f *fakeCloudDns) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/rrsets"):
+		name, rtype := r.URL.Query().Get("name"), r.URL.Query().Get("type")
+		if name == "" && rtype == "" {
+			f.zoneLists++
+		}
+		rrs := []*dns.ResourceRecordSet{}
+		for _, rr := range f.rrs {
+			if (name == "" || rr.Name == name) && (rtype == "" || rr.Type == rtype) {
+				rrs = append(rrs, rr)
+			}
+		}
+		json.NewEncoder(w).Encode(&dns.ResourceRecordSetsListResponse{Rrsets: rrs})
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/changes"):
+		change := &dns.Change{}
+		json.NewDecoder(r.Body).Decode(change)
+		after, err := applyChangeToRrsets(f.rrs, change)
+		if err != nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`{"error": {"code": 412, "message": "conditionNotMet"}}`))
+			return
+		}
+		f.rrs = after
+		f.changes = append(f.changes, change)
+		change.Status = "done"
+		json.NewEncoder(w).Encode(change)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeCloudDnsSpec(t *testing.T, rrs []*dns.ResourceRecordSet) (*CloudDNSSpec, *fakeCloudDns) {
+	fake := &fakeCloudDns{rrs: rrs}
+	return newTestCloudDnsSpec(t, fake), fake
+}
+
+// A spec for myzone (mydomain.test.) with no limits, talking to h.
+func newTestCloudDnsSpec(t *testing.T, h http.Handler) *CloudDNSSpec {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	svc, err := dns.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_project := "myproject"
+	test_zone := "myzone"
+	test_domain := "mydomain.test."
+	default_ttl := 300
+	dry_run := false
+	no_limit := -1
+	allow_empty := true
+	return &CloudDNSSpec{
+		svc:                svc,
+		project:            &test_project,
+		zone:               &test_zone,
+		domain:             &test_domain,
+		default_ttl:        &default_ttl,
+		dry_run:            &dry_run,
+		max_deletions:      &no_limit,
+		max_change_percent: &no_limit,
+		allow_empty_zone:   &allow_empty,
+	}
+}
+
+func Test_apiHandlers(t *testing.T) {
+	testDnsSpec, fake := newFakeCloudDnsSpec(t, []*dns.ResourceRecordSet{
+		{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}},
+	})
+
+	trigger := make(chan chan error)
+	go func() {
+		for done := range trigger {
+			done <- nil
+		}
+	}()
+	defer close(trigger)
+
+	mux := http.NewServeMux()
+	registerApiHandlers(mux, testDnsSpec, "s3cret", trigger)
+
+	do := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, tt := range []struct {
+		method, path, token, body string
+		want                      int
+	}{
+		{"GET", "/zone", "", "", http.StatusUnauthorized},
+		{"GET", "/zone", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/zone", "s3cret", "", http.StatusOK},
+		{"GET", "/sync", "s3cret", "", http.StatusMethodNotAllowed},
+		{"POST", "/sync", "s3cret", "", http.StatusOK},
+		{"PUT", "/records/www", "s3cret", `{"rrdatas": ["2.2.2.2"]}`, http.StatusNotFound},
+		{"PUT", "/records/www.otherdomain.test./A", "s3cret", `{"rrdatas": ["2.2.2.2"]}`, http.StatusNotFound},
+		{"PUT", "/records/www/A", "s3cret", `{"rrdatas": []}`, http.StatusBadRequest},
+		{"PUT", "/records/www/A", "s3cret", `{"ttl": 60, "rrdatas": ["2.2.2.2"]}`, http.StatusOK},
+		{"PUT", "/records/@/mx", "s3cret", `{"rrdatas": ["10 mail"]}`, http.StatusOK},
+		{"PUT", "/records/@/SOA", "s3cret", `{"rrdatas": ["ns1 hostmaster 1 21600 3600 259200 300"]}`, http.StatusBadRequest},
+		{"PUT", "/records/@/NS", "s3cret", `{"rrdatas": ["ns1.example.com."]}`, http.StatusBadRequest},
+		{"DELETE", "/records/mydomain.test./NS", "s3cret", "", http.StatusBadRequest},
+		{"PUT", "/records/sub/NS", "s3cret", `{"rrdatas": ["ns1.example.com."]}`, http.StatusOK},
+		{"DELETE", "/records/nothere/A", "s3cret", "", http.StatusNotFound},
+		{"DELETE", "/records/www.mydomain.test./A", "s3cret", "", http.StatusOK},
+	} {
+		if w := do(tt.method, tt.path, tt.token, tt.body); w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.path, w.Code, tt.want, w.Body)
+		}
+	}
+
+	want := []*dns.ResourceRecordSet{
+		{Name: "mydomain.test.", Type: "MX", Ttl: 300, Rrdatas: []string{"10 mail.mydomain.test."}},
+		{Name: "sub.mydomain.test.", Type: "NS", Ttl: 300, Rrdatas: []string{"ns1.example.com."}},
+	}
+	if !rrsetListEquals(fake.rrs, want) {
+		for _, rr := range fake.rrs {
+			t.Logf("Got: %s", describeRrset(rr))
+		}
+		t.Errorf("zone after API calls = %v, want %v", fake.rrs, want)
+	}
+
+	w := do("GET", "/zone", "s3cret", "")
+	records := []zoneRecord{}
+	if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil || len(records) != 2 || records[0].Type != "MX" {
+		t.Errorf("GET /zone = %s", w.Body)
+	}
+}
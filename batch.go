@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func splitDnsChange(change *dns.Change, maxSize int) []*dns.Change {
+	// Split change into changes of at most maxSize additions and maxSize
+	// deletions each. Everything touching the same name stays in one batch,
+	// so a modification is never a delete in one batch and an add in another,
+	// and a CNAME can replace other records. Batches that only add go first
+	// and batches that only delete go last, so nothing that's being kept
+	// ever disappears along the way.
+	if maxSize <= 0 || (len(change.Additions) <= maxSize && len(change.Deletions) <= maxSize) {
+		return []*dns.Change{change}
+	}
+
+	groups := map[string]*dns.Change{}
+	names := []string{}
+	for _, d := range diffDnsChange(change) {
+		name := normalizeName(d.Name)
+		g, ok := groups[name]
+		if !ok {
+			g = &dns.Change{}
+			groups[name] = g
+			names = append(names, name)
+		}
+		if d.New != nil {
+			g.Additions = append(g.Additions, d.New)
+		}
+		if d.Old != nil {
+			g.Deletions = append(g.Deletions, d.Old)
+		}
+	}
+
+	// 0 for adds only, 1 for a mix, 2 for deletes only.
+	order := func(g *dns.Change) int {
+		switch {
+		case len(g.Deletions) == 0:
+			return 0
+		case len(g.Additions) == 0:
+			return 2
+		}
+		return 1
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return order(groups[names[i]]) < order(groups[names[j]])
+	})
+
+	ret := []*dns.Change{}
+	var cur *dns.Change
+	for _, name := range names {
+		g := groups[name]
+		if len(g.Additions) > maxSize || len(g.Deletions) > maxSize {
+			log.Printf("Changes to %s are bigger than --max-change-size=%d on their own", name, maxSize)
+		}
+		if cur == nil || order(g) != order(cur) ||
+			len(cur.Additions)+len(g.Additions) > maxSize ||
+			len(cur.Deletions)+len(g.Deletions) > maxSize {
+			cur = &dns.Change{}
+			ret = append(ret, cur)
+		}
+		cur.Additions = append(cur.Additions, g.Additions...)
+		cur.Deletions = append(cur.Deletions, g.Deletions...)
+	}
+	return ret
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func Test_splitDnsChange(t *testing.T) {
+	a := func(name string, ip string) *dns.ResourceRecordSet {
+		return &dns.ResourceRecordSet{Name: name + ".mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{ip}}
+	}
+
+	change := &dns.Change{}
+	// Five new names.
+	for i := 0; i < 5; i++ {
+		change.Additions = append(change.Additions, a(fmt.Sprintf("new%d", i), "1.1.1.1"))
+	}
+	// Three modified ones.
+	for i := 0; i < 3; i++ {
+		change.Additions = append(change.Additions, a(fmt.Sprintf("mod%d", i), "2.2.2.2"))
+		change.Deletions = append(change.Deletions, a(fmt.Sprintf("mod%d", i), "1.1.1.1"))
+	}
+	// www goes from an A to a CNAME, which has to happen all at once.
+	change.Additions = append(change.Additions, &dns.ResourceRecordSet{Name: "www.mydomain.test.", Type: "CNAME", Ttl: 300, Rrdatas: []string{"mydomain.test."}})
+	change.Deletions = append(change.Deletions, a("www", "3.3.3.3"))
+	// Four deleted names.
+	for i := 0; i < 4; i++ {
+		change.Deletions = append(change.Deletions, a(fmt.Sprintf("old%d", i), "1.1.1.1"))
+	}
+
+	if got := splitDnsChange(change, 0); len(got) != 1 || got[0] != change {
+		t.Errorf("splitDnsChange() with no limit split the change")
+	}
+	if got := splitDnsChange(change, 100); len(got) != 1 || got[0] != change {
+		t.Errorf("splitDnsChange() split a change under the limit")
+	}
+
+	batches := splitDnsChange(change, 2)
+	adds, dels := 0, 0
+	stage := 0
+	for i, b := range batches {
+		t.Logf("Batch %d: %d additions, %d deletions", i, len(b.Additions), len(b.Deletions))
+		if len(b.Additions) > 2 || len(b.Deletions) > 2 {
+			t.Errorf("batch %d is too big", i)
+		}
+		adds += len(b.Additions)
+		dels += len(b.Deletions)
+
+		// Adds-only, then modifications, then deletes-only.
+		this := 1
+		if len(b.Deletions) == 0 {
+			this = 0
+		} else if len(b.Additions) == 0 {
+			this = 2
+		}
+		if this < stage {
+			t.Errorf("batch %d is out of order", i)
+		}
+		stage = this
+
+		// Each name's changes are all in one batch.
+		for _, x := range append(b.Additions, b.Deletions...) {
+			for j, other := range batches {
+				if j == i {
+					continue
+				}
+				for _, y := range append(other.Additions, other.Deletions...) {
+					if normalizeName(x.Name) == normalizeName(y.Name) {
+						t.Errorf("%s is split between batches %d and %d", x.Name, i, j)
+					}
+				}
+			}
+		}
+	}
+	if adds != len(change.Additions) || dels != len(change.Deletions) {
+		t.Errorf("batches have %d additions and %d deletions, want %d and %d",
+			adds, dels, len(change.Additions), len(change.Deletions))
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	zonefile "github.com/bwesterb/go-zonefile"
 	"google.golang.org/api/dns/v1"
@@ -24,6 +26,7 @@ func getResourceRecordSetsForZone(dnsSpec *CloudDNSSpec) ([]*dns.ResourceRecordS
 		}
 
 		out, err := call.Do()
+		countApiCall(dnsSpec, "ResourceRecordSets.List", err)
 
 		if err != nil {
 			return ret, err
@@ -38,62 +41,183 @@ func getResourceRecordSetsForZone(dnsSpec *CloudDNSSpec) ([]*dns.ResourceRecordS
 		nextPageToken = out.NextPageToken
 	}
 
+	countZoneRecords(dnsSpec, ret)
 	return ret, nil
 }
 
+func getRrset(dnsSpec *CloudDNSSpec, name string, rtype string) (*dns.ResourceRecordSet, error) {
+	// Just the one rrset, or nil if there isn't one.
+	call := dnsSpec.svc.ResourceRecordSets.List(*dnsSpec.project, *dnsSpec.zone).Name(normalizeName(name)).Type(rtype)
+	out, err := call.Do()
+	countApiCall(dnsSpec, "ResourceRecordSets.List", err)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range out.Rrsets {
+		if sameRrsetKey(rr, &dns.ResourceRecordSet{Name: name, Type: rtype}) {
+			return rr, nil
+		}
+	}
+	return nil, nil
+}
+
 func ZoneFileFragment(rr *dns.ResourceRecordSet) string {
 	ret := []string{}
-	if rr.Type == "SOA" {
-		// SOA
-		ret = append(ret, fmt.Sprintf("%s IN %s %s", rr.Name, rr.Type, string(rr.Rrdatas[0])))
-	} else {
-		soa_str := string("")
-		if int(rr.Ttl) != 0 {
-			soa_str = fmt.Sprintf("%s ", strconv.Itoa(int(rr.Ttl)))
-		}
-		for i := range rr.Rrdatas {
-			ret = append(ret, fmt.Sprintf("%s %sIN %s %s", rr.Name, soa_str, rr.Type, string(rr.Rrdatas[i])))
-		}
+	ttl_str := string("")
+	if int(rr.Ttl) != 0 {
+		ttl_str = fmt.Sprintf("%s ", strconv.Itoa(int(rr.Ttl)))
+	}
+	for i := range rr.Rrdatas {
+		ret = append(ret, fmt.Sprintf("%s %sIN %s %s", rr.Name, ttl_str, rr.Type, string(rr.Rrdatas[i])))
 	}
 	return strings.Join(ret, "\n")
 }
 
-func dumpZonefile(dnsSpec *CloudDNSSpec) {
+func relativeName(name string, domain string) string {
+	// The inverse of qualifyName: names in the zone lose the domain suffix.
+	if name == domain {
+		return "@"
+	}
+	if strings.HasSuffix(name, "."+domain) {
+		return strings.TrimSuffix(name, "."+domain)
+	}
+	return name
+}
 
-	rrs, err := getResourceRecordSetsForZone(dnsSpec)
-	if err != nil {
-		log.Fatal("Getting RRs for zone:", dnsSpec.zone)
+func zoneFileOrder(rrs []*dns.ResourceRecordSet, domain string) []*dns.ResourceRecordSet {
+	// Apex SOA, then apex NS, then the rest of the apex, then everything
+	// else sorted by name and type.
+	rank := func(rr *dns.ResourceRecordSet) int {
+		if rr.Name != domain {
+			return 3
+		}
+		if rr.Type == "SOA" {
+			return 0
+		}
+		if rr.Type == "NS" {
+			return 1
+		}
+		return 2
 	}
+	ret := append([]*dns.ResourceRecordSet{}, rrs...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		if rank(ret[i]) != rank(ret[j]) {
+			return rank(ret[i]) < rank(ret[j])
+		}
+		if ret[i].Name != ret[j].Name {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].Type < ret[j].Type
+	})
+	return ret
+}
 
-	// Print in order of SOA, NS, A, MX CNAME, Other
-	rtypes := []string{"SOA", "A", "MX", "CNAME"}
-	for _, rt := range rtypes {
-		for _, rr := range rrs {
-			if rr.Type == rt {
-				fmt.Println(ZoneFileFragment(rr))
-			}
+func zonefileCanParse(line string) bool {
+	_, err := zonefile.ParseEntry([]byte(line))
+	return err == nil
+}
+
+func zonefileRepresentable(rr *dns.ResourceRecordSet) bool {
+	// Whether a zonefile can hold rr at all, rather than it being commented
+	// out on the way out and missing on the way back in.
+	for _, line := range strings.Split(ZoneFileFragment(rr), "\n") {
+		if line != "" && !zonefileCanParse(line) {
+			return false
 		}
 	}
-	// Other.
-	for _, rr := range rrs {
-		othertype := true
-		for _, rt := range rtypes {
-			if rr.Type == rt {
-				othertype = false
+	return true
+}
+
+func renderZonefile(domain string, default_ttl int, rrs []*dns.ResourceRecordSet) string {
+	// Render rrsets as a zonefile that loadZonefileRrsets will read back
+	// as the same rrsets.
+	ret := []string{
+		fmt.Sprintf("$ORIGIN %s", domain),
+		fmt.Sprintf("$TTL %d", default_ttl),
+	}
+
+	for _, rr := range zoneFileOrder(rrs, domain) {
+		out := normalizeRrset(rr)
+		out.Name = relativeName(out.Name, domain)
+		sort.Strings(out.Rrdatas)
+		for _, line := range strings.Split(ZoneFileFragment(out), "\n") {
+			if line == "" {
+				continue
+			}
+			if !zonefileCanParse(line) {
+				// go-zonefile doesn't know every type Cloud DNS does (e.g. HTTPS).
+				log.Printf("Cannot represent %s (%s) in a zonefile, commenting it out", rr.Name, rr.Type)
+				line = "; " + line
 			}
+			ret = append(ret, line)
 		}
+	}
+	return strings.Join(ret, "\n") + "\n"
+}
+
+func dumpZonefile(dnsSpec *CloudDNSSpec, zoneFilename *string, format *string, gitCommit *bool) error {
+
+	rrs, err := getResourceRecordSetsForZone(dnsSpec)
+	if err != nil {
+		log.Print("Getting RRs for zone:", *dnsSpec.zone)
+		return err
+	}
+
+	zone, err := renderZone(dnsSpec, rrs, *format)
+	if err != nil {
+		return err
+	}
 
-		if othertype {
-			fmt.Println(ZoneFileFragment(rr))
+	if *zoneFilename == "" {
+		fmt.Print(zone)
+		return nil
+	}
+
+	// Work out what changed since the last export before we overwrite it.
+	summary := zonefileChangeSummary(dnsSpec, *zoneFilename, *format, zone)
+
+	err = writeFileAtomically(*zoneFilename, []byte(zone))
+	if err != nil {
+		log.Print("Error writing zonefile: ", *zoneFilename)
+		return err
+	}
+	log.Printf("Wrote %d rrsets to %s", len(rrs), *zoneFilename)
+
+	if *gitCommit {
+		return commitFileToGit(*zoneFilename, summary)
+	}
+	return nil
+}
+
+func zonefileChangeSummary(dnsSpec *CloudDNSSpec, zoneFilename string, format string, zone string) string {
+	// A commit message describing how zone differs from what's in zoneFilename.
+	old_rrs := []*dns.ResourceRecordSet{}
+	if data, err := os.ReadFile(zoneFilename); err == nil {
+		old_rrs, _, err = loadZoneRrsets(dnsSpec, data, format)
+		if err != nil {
+			log.Printf("Can't parse existing %s, treating it as empty: %s", zoneFilename, err)
+			old_rrs = []*dns.ResourceRecordSet{}
 		}
 	}
+	new_rrs, _, err := loadZoneRrsets(dnsSpec, []byte(zone), format)
+	if err != nil {
+		// We just rendered this, so it really should parse.
+		log.Printf("Can't parse exported zone: %s", err)
+	}
+
+	diffs := diffDnsChange(buildDnsChange(old_rrs, new_rrs, true, *dnsSpec.domain))
+	added, modified, removed := countDiffs(diffs)
 
+	msg := fmt.Sprintf("Export of %s (%s): %d added, %d removed, %d modified",
+		*dnsSpec.zone, *dnsSpec.domain, added, removed, modified)
+	if len(diffs) > 0 {
+		msg += "\n\n" + strings.TrimSuffix(renderPlanText(diffs, false), "\n")
+	}
+	return msg
 }
 
 func rrsetsEqual(x *dns.ResourceRecordSet, y *dns.ResourceRecordSet) bool {
-	if x.Type != y.Type ||
-		x.Name != y.Name ||
-		x.Ttl != y.Ttl {
+	if !sameRrsetKey(x, y) || x.Ttl != y.Ttl {
 		return false
 	}
 
@@ -101,9 +225,16 @@ func rrsetsEqual(x *dns.ResourceRecordSet, y *dns.ResourceRecordSet) bool {
 		return false
 	}
 
-	for _, xv := range x.Rrdatas {
+	if !routingPoliciesEqual(x.RoutingPolicy, y.RoutingPolicy) {
+		return false
+	}
+
+	// Compare rdata in canonical form, so '::1' == '0:0::1' and so forth.
+	nx := normalizeRrset(x)
+	ny := normalizeRrset(y)
+	for _, xv := range nx.Rrdatas {
 		found := false
-		for _, yv := range y.Rrdatas {
+		for _, yv := range ny.Rrdatas {
 			if xv == yv {
 				found = true
 			}
@@ -115,6 +246,12 @@ func rrsetsEqual(x *dns.ResourceRecordSet, y *dns.ResourceRecordSet) bool {
 	return true
 }
 
+func sameRrsetKey(x *dns.ResourceRecordSet, y *dns.ResourceRecordSet) bool {
+	// Whether x and y are the same name and type, i.e. the same rrset in Cloud DNS.
+	return strings.EqualFold(x.Type, y.Type) &&
+		normalizeName(x.Name) == normalizeName(y.Name)
+}
+
 func addDomainForZone(name string, domain string) string {
 	if !strings.HasSuffix(name, ".") {
 		return name + "." + domain
@@ -123,18 +260,27 @@ func addDomainForZone(name string, domain string) string {
 }
 
 func processCloudDnsChange(dnsSpec *CloudDNSSpec, dnsChange *dns.Change) error {
+	return applyCloudDnsChange(dnsSpec, dnsChange, "")
+}
+
+func applyCloudDnsChange(dnsSpec *CloudDNSSpec, dnsChange *dns.Change, reverts string) error {
+	// reverts is the ID of the change this one rolls back, if any, for the journal.
 	if dnsChange == nil || (len(dnsChange.Additions) == 0 && len(dnsChange.Deletions) == 0) {
 		log.Printf("No DNS changes for Cloud")
 		return nil
 	}
 
-	log.Printf("Adding %d entries to Cloud DNS", len(dnsChange.Additions))
-	for _, a := range dnsChange.Additions {
-		log.Printf(" + %s (%s) %s", a.Name, a.Type, strings.Join(a.Rrdatas, " "))
+	log.Printf("Adding %d and removing %d entries in Cloud DNS", len(dnsChange.Additions), len(dnsChange.Deletions))
+	for _, d := range diffDnsChange(dnsChange) {
+		for _, l := range renderRrsetDiff(d, false) {
+			log.Print(" ", l)
+		}
 	}
-	log.Printf("Removing %d entries from Cloud DNS", len(dnsChange.Deletions))
-	for _, a := range dnsChange.Deletions {
-		log.Printf(" - %s (%s) %s", a.Name, a.Type, strings.Join(a.Rrdatas, " "))
+
+	err := enforceChangeLimits(dnsSpec, dnsChange)
+	if err != nil {
+		log.Printf("Refusing to update Cloud DNS: %s", err)
+		return err
 	}
 
 	if *dnsSpec.dry_run {
@@ -142,19 +288,59 @@ func processCloudDnsChange(dnsSpec *CloudDNSSpec, dnsChange *dns.Change) error {
 		return nil
 	}
 
+	err = snapshotZone(dnsSpec)
+	if err != nil {
+		log.Printf("Not updating Cloud DNS, couldn't snapshot zone: %s", err)
+		return err
+	}
+
+	maxSize := 0
+	if dnsSpec.max_change_size != nil {
+		maxSize = *dnsSpec.max_change_size
+	}
+	batches := splitDnsChange(dnsChange, maxSize)
+	for i, batch := range batches {
+		if len(batches) > 1 {
+			log.Printf("Batch %d of %d: adding %d and removing %d entries",
+				i+1, len(batches), len(batch.Additions), len(batch.Deletions))
+		}
+		err = submitCloudDnsChange(dnsSpec, batch, reverts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func submitCloudDnsChange(dnsSpec *CloudDNSSpec, dnsChange *dns.Change, reverts string) error {
+	start := time.Now()
 	call := dnsSpec.svc.Changes.Create(*dnsSpec.project, *dnsSpec.zone, dnsChange)
 	out, err := call.Do()
+	countApiCall(dnsSpec, "Changes.Create", err)
 	if err != nil {
 		log.Printf("Error updating Cloud DNS: %s", err)
 	} else {
-		log.Printf("Added [%d] and deleted [%d] records.",
-			len(out.Additions), len(out.Deletions))
-		dnsChangesProcessed.Inc()
+		log.Printf("Added [%d] and deleted [%d] records in change %s.",
+			len(out.Additions), len(out.Deletions), out.Id)
+		dnsChangesProcessed.WithLabelValues(*dnsSpec.zone).Inc()
+		countChangedRrsets(dnsSpec, out)
+		if dnsSpec.on_change != nil {
+			dnsSpec.on_change(out)
+		}
+		// The change is made by now, so don't fail over the journal.
+		if jerr := appendJournal(dnsSpec, out, reverts); jerr != nil {
+			log.Printf("Error writing change %s to journal: %s", out.Id, jerr)
+		}
+		// Likewise, failing now would only retry or abandon a change
+		// that's already been made.
+		if werr := waitForChange(dnsSpec, out, start); werr != nil {
+			log.Printf("Change %s was made, but not confirmed: %s", out.Id, werr)
+		}
 	}
 	return err
 }
 
-func buildNomadDnsChange(dnsSpec *CloudDNSSpec, tasks []TaskInfo, pruneMissing bool) (*dns.Change, error) {
+func buildNomadDnsChange(dnsSpec *CloudDNSSpec, tasks []TaskInfo, pruneMissing bool) (*dns.Change, []*dns.ResourceRecordSet, error) {
 	// Build a new TaskInfo with fully qualified dns names.
 	fq_taskinfo := []TaskInfo{}
 	for _, t := range tasks {
@@ -167,18 +353,19 @@ func buildNomadDnsChange(dnsSpec *CloudDNSSpec, tasks []TaskInfo, pruneMissing b
 	nomad_rrs, err := buildTaskInfoToRrsets(fq_taskinfo, dnsSpec.default_ttl)
 	if err != nil {
 		log.Print("Converting Nomad RRs for zone:", dnsSpec.zone)
-		return nil, err
+		return nil, nil, err
 	}
 
 	cloud_rrs, err := getResourceRecordSetsForZone(dnsSpec)
 	if err != nil {
 		log.Print("Getting Cloud DNS RRs for zone:", dnsSpec.zone)
-		return nil, err
+		return nil, nil, err
 	}
 
-	ret := buildDnsChange(cloud_rrs, nomad_rrs, pruneMissing)
+	ret := buildDnsChange(cloud_rrs, nomad_rrs, pruneMissing, *dnsSpec.domain)
+	recordDrift(dnsSpec, nomad_rrs, cloud_rrs, ret)
 
-	return ret, nil
+	return ret, cloud_rrs, nil
 }
 
 func buildTaskInfoToRrsets(tasks []TaskInfo, default_ttl *int) ([]*dns.ResourceRecordSet, error) {
@@ -228,6 +415,7 @@ func populateDnsSpec(dnsSpec *CloudDNSSpec) error {
 	}
 	call := dnsSpec.svc.ManagedZones.List(*dnsSpec.project)
 	out, err := call.Do()
+	countApiCall(dnsSpec, "ManagedZones.List", err)
 	if err != nil {
 		log.Printf("Error Getting zones for project %s: %s", *dnsSpec.project, err)
 		return err
@@ -243,30 +431,32 @@ func populateDnsSpec(dnsSpec *CloudDNSSpec) error {
 	return errors.New(errmsg)
 }
 
-func mergeZoneEntryIntoRrsets(dnsSpec *CloudDNSSpec, rrs []*dns.ResourceRecordSet, e zonefile.Entry) []*dns.ResourceRecordSet {
+func mergeZoneEntryIntoRrsets(dnsSpec *CloudDNSSpec, rrs []*dns.ResourceRecordSet, e zonefile.Entry, origin string) []*dns.ResourceRecordSet {
 	// Ignore control entries
 	if e.Command() != nil {
 		return rrs
 	}
 
-	// Also ignore SOA/NS records, since these are managed by gcloud.
-	if string(e.Type()) == "SOA" || string(e.Type()) == "NS" {
-		return rrs
+	// fully qualify the name, as this is what cloud dns does.
+	e_fqdn := qualifyName(string(e.Domain()), origin)
+	if e.Domain() == nil {
+		// No owner at all, we assume the origin.
+		e_fqdn = origin
 	}
+	e_type := string(e.Type())
 
-	// fully qualify the name, as this is what cloud dns does.
-	e_fqdn := addDomainForZone(string(e.Domain()), *dnsSpec.domain)
-	if string(e.Domain()) == "@" {
-		// Technically it's whatever $ORIGIN is set to but whatevsies it's only DNS.
-		e_fqdn = *dnsSpec.domain
+	// Also ignore SOA and apex NS records, since these are managed by gcloud.
+	// NS records further down are delegations and are fair game.
+	if e_type == "SOA" || (e_type == "NS" && e_fqdn == *dnsSpec.domain) {
+		return rrs
 	}
 
-	// Create a new rrset if this is the first sighting of this name,
+	// Create a new rrset if this is the first sighting of this name and type,
 	// otherwise add the new rr to the existing one.
 	found := false
 	this_rrset := &dns.ResourceRecordSet{}
 	for _, rr := range rrs {
-		if rr.Name == e_fqdn && rr.Type != "SOA" && rr.Type != "NS" {
+		if rr.Name == e_fqdn && rr.Type == e_type {
 			found = true
 			this_rrset = rr
 		}
@@ -275,15 +465,9 @@ func mergeZoneEntryIntoRrsets(dnsSpec *CloudDNSSpec, rrs []*dns.ResourceRecordSe
 		rrs = append(rrs, this_rrset)
 	}
 
-	// Now, populate the rrset, either adding or appending the new answer.
-	for _, rd := range e.Values() {
-		if string(e.Type()) == "CNAME" {
-			// for 'naked' cnames, add the domain to the rrdata
-			this_rrset.Rrdatas = append(this_rrset.Rrdatas, addDomainForZone(string(rd), *dnsSpec.domain))
-		} else {
-			this_rrset.Rrdatas = append(this_rrset.Rrdatas, string(rd))
-		}
-	}
+	// Now, populate the rrset, qualifying any relative names in the rdata.
+	rdata := rdataFromZoneValues(e_type, e.Values())
+	this_rrset.Rrdatas = append(this_rrset.Rrdatas, qualifyRdata(e_type, rdata, origin))
 	this_rrset.Kind = string(e.Class())
 	this_rrset.Name = e_fqdn
 	// Fuck's sake.
@@ -292,61 +476,155 @@ func mergeZoneEntryIntoRrsets(dnsSpec *CloudDNSSpec, rrs []*dns.ResourceRecordSe
 	} else {
 		this_rrset.Ttl = int64(*dnsSpec.default_ttl)
 	}
-	this_rrset.Type = string(e.Type())
+	this_rrset.Type = e_type
 
 	return rrs
 }
 
-func uploadZonefile(dnsSpec *CloudDNSSpec, zoneFilename *string, dryRun *bool, pruneMissing *bool) error {
-	data, err := os.ReadFile(*zoneFilename)
-	if err != nil {
-		log.Print("Error opening zonefile: ", zoneFilename)
-		return err
-	}
-
+func loadZonefileRrsets(dnsSpec *CloudDNSSpec, data []byte) ([]*dns.ResourceRecordSet, []string, error) {
+	// Returns the rrsets along with a list of problems that didn't stop us
+	// parsing the zone, but probably should be fixed.
 	zf, err := zonefile.Load(data)
 	if err != nil {
-		log.Print("Error parsing zonefile: ", err)
-		return err
+		return nil, nil, err
 	}
 
 	// The format go-zonefile uses to represent RRs gives me hives.
-	// Convert the go-zonefile format to a list of *dns.ResourceRecordSet
+	// Convert the go-zonefile format to a list of *dns.ResourceRecordSet,
+	// keeping track of $ORIGIN, $TTL and the last owner name as we go.
+	origin := *dnsSpec.domain
+	last_name := ""
+	var zone_ttl *int
 	zone_rrs := []*dns.ResourceRecordSet{}
+	problems := []string{}
 
 	for _, e := range zf.Entries() {
-		zone_rrs = mergeZoneEntryIntoRrsets(dnsSpec, zone_rrs, e)
+		if string(e.Command()) == "$ORIGIN" && len(e.Values()) > 0 {
+			origin = qualifyName(string(e.Values()[0]), origin)
+			continue
+		}
+		if string(e.Command()) == "$TTL" && len(e.Values()) > 0 {
+			ttl, err := strconv.Atoi(string(e.Values()[0]))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid $TTL: %s", e.Values()[0])
+			}
+			zone_ttl = &ttl
+			continue
+		}
+		if e.Command() == nil {
+			if e.Domain() == nil && last_name != "" {
+				// A blank owner means 'same as the previous record'.
+				e.SetDomain([]byte(last_name))
+			}
+			if e.Domain() != nil {
+				last_name = qualifyName(string(e.Domain()), origin)
+			}
+			if e.TTL() == nil && zone_ttl != nil {
+				e.SetTTL(*zone_ttl)
+			}
+			if p := zoneEntryTtlConflict(dnsSpec, zone_rrs, e, origin); p != "" {
+				problems = append(problems, p)
+			}
+		}
+		zone_rrs = mergeZoneEntryIntoRrsets(dnsSpec, zone_rrs, e, origin)
 	}
 
 	log.Printf("Processing %d zonefile entries rendered %d rrsets", len(zf.Entries()), len(zone_rrs))
 
+	return zone_rrs, problems, nil
+}
+
+func zoneEntryTtlConflict(dnsSpec *CloudDNSSpec, rrs []*dns.ResourceRecordSet, e zonefile.Entry, origin string) string {
+	// Cloud DNS has one TTL per rrset, so entries for the same name and type
+	// with different TTLs can't both be honoured. The last one wins.
+	name := origin
+	if e.Domain() != nil {
+		name = qualifyName(string(e.Domain()), origin)
+	}
+	ttl := int64(*dnsSpec.default_ttl)
+	if e.TTL() != nil {
+		ttl = int64(*e.TTL())
+	}
+	for _, rr := range rrs {
+		if rr.Name == name && rr.Type == string(e.Type()) && rr.Ttl != ttl {
+			return fmt.Sprintf("%s (%s): conflicting TTLs %d and %d", name, rr.Type, rr.Ttl, ttl)
+		}
+	}
+	return ""
+}
+
+func buildZonefileChange(dnsSpec *CloudDNSSpec, zoneFilename *string, format *string, pruneMissing *bool) (*dns.Change, []*dns.ResourceRecordSet, error) {
+	// Work out the change needed to make Cloud DNS match zoneFilename.
+	// Also returns the Cloud DNS rrsets the change was computed against.
+	data, err := os.ReadFile(*zoneFilename)
+	if err != nil {
+		log.Print("Error opening zonefile: ", *zoneFilename)
+		return nil, nil, err
+	}
+
+	zone_rrs, problems, err := loadZoneRrsets(dnsSpec, data, *format)
+	if err != nil {
+		log.Print("Error parsing zonefile: ", err)
+		return nil, nil, err
+	}
+	for _, p := range problems {
+		log.Print("Warning: ", p)
+	}
+
 	cloud_rrs, err := getResourceRecordSetsForZone(dnsSpec)
 	if err != nil {
-		log.Fatal("Getting RRs for zone:", dnsSpec.zone)
+		log.Print("Getting RRs for zone:", *dnsSpec.zone)
+		return nil, nil, err
+	}
+
+	// A zonefile can't hold some types (getzonefile comments them out), so
+	// their being missing from one doesn't mean they should be pruned.
+	managed_rrs := cloud_rrs
+	if *format == "zonefile" {
+		managed_rrs = []*dns.ResourceRecordSet{}
+		for _, rr := range cloud_rrs {
+			if !zonefileRepresentable(rr) {
+				log.Printf("Leaving %s (%s) alone, it can't be represented in a zonefile", rr.Name, rr.Type)
+				continue
+			}
+			managed_rrs = append(managed_rrs, rr)
+		}
 	}
 
-	change := buildDnsChange(cloud_rrs, zone_rrs, *pruneMissing)
+	change := buildDnsChange(managed_rrs, zone_rrs, *pruneMissing, *dnsSpec.domain)
+	recordDrift(dnsSpec, zone_rrs, managed_rrs, change)
+	return change, cloud_rrs, nil
+}
 
-	if *dryRun {
+func uploadZonefile(dnsSpec *CloudDNSSpec, zoneFilename *string, format *string, dryRun *bool, pruneMissing *bool, planFile *string) error {
+	if *dryRun && *planFile != "" {
+		change, cloud_rrs, err := buildZonefileChange(dnsSpec, zoneFilename, format, pruneMissing)
+		if err != nil {
+			return err
+		}
 		log.Print("Running in dry run mode. Not actually updating Cloud DNS.")
+		return writePlanFile(dnsSpec, *planFile, change, cloud_rrs)
 	}
 
-	return processCloudDnsChange(dnsSpec, change)
+	return syncCloudDns(dnsSpec, func() (*dns.Change, error) {
+		change, _, err := buildZonefileChange(dnsSpec, zoneFilename, format, pruneMissing)
+		return change, err
+	})
 }
 
-func buildDnsChange(cloud_rrs, zone_rrs []*dns.ResourceRecordSet, prune_missing bool) *dns.Change {
+func buildDnsChange(cloud_rrs, zone_rrs []*dns.ResourceRecordSet, prune_missing bool, domain string) *dns.Change {
 
 	ret := dns.Change{}
 
 	for _, z := range zone_rrs {
 		found := false
 		for _, c := range cloud_rrs {
-			if z.Type == c.Type && z.Name == c.Name {
+			if sameRrsetKey(z, c) {
 				found = true
 				if !rrsetsEqual(z, c) {
 					// Modify means a delete of the exact old record plus
 					// addition of the new one.
-					ret.Additions = append(ret.Additions, z)
+					ret.Additions = append(ret.Additions, normalizeRrset(z))
 					ret.Deletions = append(ret.Deletions, c)
 					break
 				}
@@ -354,17 +632,19 @@ func buildDnsChange(cloud_rrs, zone_rrs []*dns.ResourceRecordSet, prune_missing
 		}
 		if !found {
 			// Not found in Cloud DNS, set for addition
-			ret.Additions = append(ret.Additions, z)
+			ret.Additions = append(ret.Additions, normalizeRrset(z))
 		}
 	}
 	if prune_missing {
 		for _, c := range cloud_rrs {
 			found := false
-			if c.Type == "SOA" || c.Type == "NS" {
+			// The SOA and apex NS are Cloud DNS's, but delegations further
+			// down are ours to remove.
+			if c.Type == "SOA" || (c.Type == "NS" && normalizeName(c.Name) == normalizeName(domain)) {
 				continue
 			}
 			for _, z := range zone_rrs {
-				if c.Name == z.Name && c.Type == z.Type {
+				if sameRrsetKey(c, z) {
 					found = true
 				}
 			}
@@ -379,30 +659,30 @@ func buildDnsChange(cloud_rrs, zone_rrs []*dns.ResourceRecordSet, prune_missing
 
 }
 
-func updateOneARecord(dns_spec *CloudDNSSpec, record_name string, old_ip, new_ip string) error {
-
-	log.Printf("Updating Cloud DNS: %s : %s -> %s", record_name, old_ip, new_ip)
+func updateOneRecord(dns_spec *CloudDNSSpec, current *dns.ResourceRecordSet, record_name string, rtype string, new_ip string) error {
+	// Replace current, the rrset as it is in Cloud DNS right now or nil if
+	// there isn't one, with just new_ip.
+	old_ips := []string{}
+	if current != nil {
+		old_ips = current.Rrdatas
+	}
+	log.Printf("Updating Cloud DNS: %s (%s) : %s -> %s", record_name, rtype, strings.Join(old_ips, ","), new_ip)
 
 	change := &dns.Change{
 		Additions: []*dns.ResourceRecordSet{
 			{
 				Name:    record_name,
-				Type:    "A",
+				Type:    rtype,
 				Rrdatas: []string{new_ip},
 				Ttl:     int64(*dns_spec.default_ttl),
 			},
 		},
 	}
 
-	// Gcloud DNS shits the bed if you try to delete a record that's not there.
-	if old_ip != "" {
-		new_rr := dns.ResourceRecordSet{
-			Name:    record_name,
-			Type:    "A",
-			Rrdatas: []string{old_ip},
-			Ttl:     int64(*dns_spec.default_ttl),
-		}
-		change.Deletions = append(change.Deletions, &new_rr)
+	// Gcloud DNS shits the bed if you try to delete a record that's not
+	// there, or that's not exactly as it is, TTL and all.
+	if current != nil {
+		change.Deletions = append(change.Deletions, current)
 	}
 
 	return processCloudDnsChange(dns_spec, change)
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -146,6 +148,54 @@ func Test_rrsetsEqual(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "EquivalentIPv6",
+			args: args{
+				x: &dns.ResourceRecordSet{
+					Type:    "AAAA",
+					Name:    "hostname.example.com.",
+					Rrdatas: []string{"::1"},
+				},
+				y: &dns.ResourceRecordSet{
+					Type:    "AAAA",
+					Name:    "hostname.example.com.",
+					Rrdatas: []string{"0:0::1"},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "NameCaseAndTrailingDot",
+			args: args{
+				x: &dns.ResourceRecordSet{
+					Type:    "CNAME",
+					Name:    "HostName.example.com",
+					Rrdatas: []string{"Other.example.com"},
+				},
+				y: &dns.ResourceRecordSet{
+					Type:    "CNAME",
+					Name:    "hostname.example.com.",
+					Rrdatas: []string{"other.example.com."},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "TXTQuoting",
+			args: args{
+				x: &dns.ResourceRecordSet{
+					Type:    "TXT",
+					Name:    "hostname.example.com.",
+					Rrdatas: []string{"v=spf1"},
+				},
+				y: &dns.ResourceRecordSet{
+					Type:    "TXT",
+					Name:    "hostname.example.com.",
+					Rrdatas: []string{`"v=spf1"`},
+				},
+			},
+			want: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -178,6 +228,16 @@ func TestZoneFileFragment(t *testing.T) {
 			}},
 			want: " IN SOA doot. root.doot. 0 0 0",
 		},
+		{
+			name: "SOAWithTTL",
+			args: args{rr: &dns.ResourceRecordSet{
+				Type:    "SOA",
+				Name:    "@",
+				Ttl:     21600,
+				Rrdatas: []string{"doot. root.doot. 0 0 0"},
+			}},
+			want: "@ 21600 IN SOA doot. root.doot. 0 0 0",
+		},
 		{
 			name: "SimpleA",
 			args: args{rr: &dns.ResourceRecordSet{
@@ -397,10 +457,74 @@ func Test_mergeZoneEntryIntoRrsets(t *testing.T) {
 				},
 			},
 		},
+		{
+			// Relative MX exchange gets qualified, and preference stays put.
+			name: "qualifyMXRdata",
+			args: args{
+				dnsSpec: testDnsSpec,
+				rrs:     []*dns.ResourceRecordSet{},
+				e:       sloppyParseEntry("@ IN MX 10 mail"),
+			},
+			want: []*dns.ResourceRecordSet{
+				{
+					Name:    test_domain,
+					Type:    "MX",
+					Ttl:     int64(default_ttl),
+					Rrdatas: []string{"10 mail." + test_domain},
+				},
+			},
+		},
+		{
+			// Delegations below the apex are kept, and qualified.
+			name: "delegatedNS",
+			args: args{
+				dnsSpec: testDnsSpec,
+				rrs:     []*dns.ResourceRecordSet{},
+				e:       sloppyParseEntry("sub IN NS ns1.sub"),
+			},
+			want: []*dns.ResourceRecordSet{
+				{
+					Name:    "sub." + test_domain,
+					Type:    "NS",
+					Ttl:     int64(default_ttl),
+					Rrdatas: []string{"ns1.sub." + test_domain},
+				},
+			},
+		},
+		{
+			// Same name, different type is a different rrset.
+			name: "sameNameDifferentType",
+			args: args{
+				dnsSpec: testDnsSpec,
+				rrs: []*dns.ResourceRecordSet{
+					{
+						Name:    "www." + test_domain,
+						Type:    "A",
+						Ttl:     int64(default_ttl),
+						Rrdatas: []string{"1.2.3.4"},
+					},
+				},
+				e: sloppyParseEntry(`www IN TXT "hello world"`),
+			},
+			want: []*dns.ResourceRecordSet{
+				{
+					Name:    "www." + test_domain,
+					Type:    "A",
+					Ttl:     int64(default_ttl),
+					Rrdatas: []string{"1.2.3.4"},
+				},
+				{
+					Name:    "www." + test_domain,
+					Type:    "TXT",
+					Ttl:     int64(default_ttl),
+					Rrdatas: []string{`"hello world"`},
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := mergeZoneEntryIntoRrsets(tt.args.dnsSpec, tt.args.rrs, tt.args.e); !rrsetListEquals(got, tt.want) {
+			if got := mergeZoneEntryIntoRrsets(tt.args.dnsSpec, tt.args.rrs, tt.args.e, *tt.args.dnsSpec.domain); !rrsetListEquals(got, tt.want) {
 				for _, rr := range tt.want {
 					t.Logf("Want: %s", describeRrset(rr))
 				}
@@ -491,6 +615,16 @@ func Test_buildDnsChange(t *testing.T) {
 		Type:    "CNAME",
 		Rrdatas: []string{"doot.doot."},
 	}
+	apexNsRecord := &dns.ResourceRecordSet{
+		Name:    "doot.",
+		Type:    "NS",
+		Rrdatas: []string{"ns-cloud-a1.googledomains.com."},
+	}
+	delegationNsRecord := &dns.ResourceRecordSet{
+		Name:    "sub.doot.",
+		Type:    "NS",
+		Rrdatas: []string{"ns1.example.com."},
+	}
 
 	type args struct {
 		cloud_rrs     []*dns.ResourceRecordSet
@@ -544,6 +678,17 @@ func Test_buildDnsChange(t *testing.T) {
 				Deletions: []*dns.ResourceRecordSet{simpleARecord},
 			},
 		},
+		{
+			name: "PruneMissingDelegation",
+			args: args{
+				cloud_rrs:     []*dns.ResourceRecordSet{apexNsRecord, delegationNsRecord, simpleARecord},
+				zone_rrs:      []*dns.ResourceRecordSet{simpleARecord},
+				prune_missing: true,
+			},
+			want: &dns.Change{
+				Deletions: []*dns.ResourceRecordSet{delegationNsRecord},
+			},
+		},
 		{
 			name: "ReplaceExistingRecord",
 			args: args{
@@ -559,9 +704,126 @@ func Test_buildDnsChange(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := buildDnsChange(tt.args.cloud_rrs, tt.args.zone_rrs, tt.args.prune_missing); !reflect.DeepEqual(got, tt.want) {
+			if got := buildDnsChange(tt.args.cloud_rrs, tt.args.zone_rrs, tt.args.prune_missing, "doot."); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("buildDnsChange() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func Test_loadZonefileRrsets(t *testing.T) {
+	test_domain := "mydomain.test."
+	default_ttl := 300
+	testDnsSpec := &CloudDNSSpec{
+		default_ttl: &default_ttl,
+		domain:      &test_domain,
+	}
+
+	zone := `@ IN NS ns1.example.com.
+www IN A 1.2.3.4
+    IN A 5.6.7.8
+$ORIGIN sub
+mail IN A 9.9.9.9
+@ IN MX 10 mail
+`
+	want := []*dns.ResourceRecordSet{
+		{
+			Name:    "www." + test_domain,
+			Type:    "A",
+			Ttl:     int64(default_ttl),
+			Rrdatas: []string{"1.2.3.4", "5.6.7.8"},
+		},
+		{
+			Name:    "mail.sub." + test_domain,
+			Type:    "A",
+			Ttl:     int64(default_ttl),
+			Rrdatas: []string{"9.9.9.9"},
+		},
+		{
+			Name:    "sub." + test_domain,
+			Type:    "MX",
+			Ttl:     int64(default_ttl),
+			Rrdatas: []string{"10 mail.sub." + test_domain},
+		},
+	}
+
+	got, _, err := loadZonefileRrsets(testDnsSpec, []byte(zone))
+	if err != nil {
+		t.Fatalf("loadZonefileRrsets() error = %v", err)
+	}
+	if !rrsetListEquals(got, want) {
+		for _, rr := range want {
+			t.Logf("Want: %s", describeRrset(rr))
+		}
+		for _, rr := range got {
+			t.Logf("Got : %s", describeRrset(rr))
+		}
+		t.Errorf("loadZonefileRrsets() = %v, want %v", got, want)
+	}
+}
+
+func Test_renderZonefileRoundTrip(t *testing.T) {
+	// What Cloud DNS might hand back for a zone.
+	cloud_rrs := []*dns.ResourceRecordSet{
+		{Name: "mydomain.test.", Type: "SOA", Ttl: 21600, Rrdatas: []string{"ns-cloud-a1.googledomains.com. cloud-dns-hostmaster.google.com. 1 21600 3600 259200 300"}},
+		{Name: "mydomain.test.", Type: "NS", Ttl: 21600, Rrdatas: []string{"ns-cloud-a1.googledomains.com.", "ns-cloud-a2.googledomains.com."}},
+		{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"5.6.7.8", "1.2.3.4"}},
+		{Name: "www.mydomain.test.", Type: "AAAA", Ttl: 60, Rrdatas: []string{"2001:db8::1"}},
+		{Name: "www.mydomain.test.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"v=spf1 include:_spf.example.com ~all"`, `"say \"hi\"" "two"`}},
+		// Non-ASCII comes out as \DDD escapes, which need to come back as the same bytes.
+		{Name: "hello.mydomain.test.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"h\195\169llo"`, `"\226\130\172 5"`}},
+		{Name: "mydomain.test.", Type: "MX", Ttl: 3600, Rrdatas: []string{"10 mail.mydomain.test.", "20 mx.example.com."}},
+		{Name: "mydomain.test.", Type: "CAA", Ttl: 300, Rrdatas: []string{`0 issue "letsencrypt.org"`}},
+		{Name: "ftp.mydomain.test.", Type: "CNAME", Ttl: 300, Rrdatas: []string{"www.mydomain.test."}},
+		{Name: "_sip._tcp.mydomain.test.", Type: "SRV", Ttl: 300, Rrdatas: []string{"10 20 5060 sip.example.com."}},
+		{Name: "sub.mydomain.test.", Type: "NS", Ttl: 300, Rrdatas: []string{"ns1.example.com."}},
+		// go-zonefile can't parse these, so they're commented out.
+		{Name: "www.mydomain.test.", Type: "HTTPS", Ttl: 300, Rrdatas: []string{"1 . alpn=h3"}},
+	}
+	testDnsSpec, _ := newFakeCloudDnsSpec(t, cloud_rrs)
+
+	zone := renderZonefile(*testDnsSpec.domain, *testDnsSpec.default_ttl, cloud_rrs)
+	t.Logf("Zonefile:\n%s", zone)
+	if !strings.Contains(zone, "; www 300 IN HTTPS 1 . alpn=h3") {
+		t.Errorf("HTTPS record isn't commented out in the zonefile")
+	}
+
+	zone_filename := filepath.Join(t.TempDir(), "myzone.zone")
+	os.WriteFile(zone_filename, []byte(zone), 0644)
+	format := "zonefile"
+	prune := true
+	change, _, err := buildZonefileChange(testDnsSpec, &zone_filename, &format, &prune)
+	if err != nil {
+		t.Fatalf("buildZonefileChange() error = %v", err)
+	}
+	for _, rr := range change.Additions {
+		t.Logf("Addition: %s", describeRrset(rr))
+	}
+	for _, rr := range change.Deletions {
+		t.Logf("Deletion: %s", describeRrset(rr))
+	}
+	if len(change.Additions) != 0 || len(change.Deletions) != 0 {
+		t.Errorf("getzonefile then putzonefile --prune-missing is not a no-op")
+	}
+}
+
+func Test_renderZonefileOrder(t *testing.T) {
+	rrs := []*dns.ResourceRecordSet{
+		{Name: "b.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4"}},
+		{Name: "a.mydomain.test.", Type: "TXT", Ttl: 300, Rrdatas: []string{"hello"}},
+		{Name: "a.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4"}},
+		{Name: "mydomain.test.", Type: "NS", Ttl: 21600, Rrdatas: []string{"ns1.example.com."}},
+		{Name: "mydomain.test.", Type: "SOA", Ttl: 21600, Rrdatas: []string{"ns1.example.com. root.example.com. 1 2 3 4 5"}},
+	}
+	want := `$ORIGIN mydomain.test.
+$TTL 300
+@ 21600 IN SOA ns1.example.com. root.example.com. 1 2 3 4 5
+@ 21600 IN NS ns1.example.com.
+a 300 IN A 1.2.3.4
+a 300 IN TXT "hello"
+b 300 IN A 1.2.3.4
+`
+	if got := renderZonefile("mydomain.test.", 300, rrs); got != want {
+		t.Errorf("renderZonefile() = '%v', want '%v'", got, want)
+	}
+}
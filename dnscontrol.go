@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/dns/v1"
+)
+
+// The bits of 'dnscontrol print-ir' output we care about.
+type dnscontrolConfig struct {
+	Domains []struct {
+		Name    string             `json:"name"`
+		Records []dnscontrolRecord `json:"records"`
+	} `json:"domains"`
+}
+
+type dnscontrolRecord struct {
+	Type         string   `json:"type"`
+	Name         string   `json:"name"`
+	Target       string   `json:"target"`
+	Ttl          int64    `json:"ttl"`
+	MxPreference int      `json:"mxpreference"`
+	SrvPriority  int      `json:"srvpriority"`
+	SrvWeight    int      `json:"srvweight"`
+	SrvPort      int      `json:"srvport"`
+	CaaTag       string   `json:"caatag"`
+	CaaFlag      int      `json:"caaflag"`
+	TxtStrings   []string `json:"txtstrings"`
+}
+
+func dnscontrolRdata(r dnscontrolRecord) (string, error) {
+	rtype := strings.ToUpper(r.Type)
+	switch rtype {
+	case "A", "AAAA", "CNAME", "NS", "PTR":
+		return r.Target, nil
+	case "MX":
+		return fmt.Sprintf("%d %s", r.MxPreference, r.Target), nil
+	case "SRV":
+		return fmt.Sprintf("%d %d %d %s", r.SrvPriority, r.SrvWeight, r.SrvPort, r.Target), nil
+	case "CAA":
+		return fmt.Sprintf("%d %s %s", r.CaaFlag, r.CaaTag, quoteTxtString(r.Target)), nil
+	case "TXT", "SPF":
+		// Older dnscontrol versions split TXT into txtstrings, newer ones
+		// just have the target.
+		strs := r.TxtStrings
+		if len(strs) == 0 {
+			strs = []string{r.Target}
+		}
+		quoted := []string{}
+		for _, s := range strs {
+			quoted = append(quoted, quoteTxtString(s))
+		}
+		return strings.Join(quoted, " "), nil
+	}
+	return "", fmt.Errorf("unsupported dnscontrol record type %s", rtype)
+}
+
+func loadDnscontrolRrsets(dnsSpec *CloudDNSSpec, data []byte) ([]*dns.ResourceRecordSet, []string, error) {
+	config := dnscontrolConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, err
+	}
+
+	// dnscontrol configs can hold many domains, we only want ours.
+	want := strings.TrimSuffix(strings.ToLower(*dnsSpec.domain), ".")
+	for _, d := range config.Domains {
+		if strings.TrimSuffix(strings.ToLower(d.Name), ".") != want {
+			continue
+		}
+
+		records := []zoneRecord{}
+		for _, r := range d.Records {
+			rd, err := dnscontrolRdata(r)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", r.Name, err)
+			}
+			records = append(records, zoneRecord{
+				Name:    r.Name,
+				Type:    r.Type,
+				Ttl:     r.Ttl,
+				Rrdatas: []string{rd},
+			})
+		}
+		return zoneRecordsToRrsets(dnsSpec, records, "dnscontrol")
+	}
+
+	return nil, nil, fmt.Errorf("domain %s not found in dnscontrol config", want)
+}
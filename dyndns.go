@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --dyndns-users-file: who may update which hostnames.
+//
+//	router:
+//	  password: hunter2
+//	  hostnames: [router, nas.mydomain.tld.]
+type dyndnsUser struct {
+	Password  string   `yaml:"password"`
+	Hostnames []string `yaml:"hostnames"`
+}
+
+type dyndnsServer struct {
+	dnsSpec *CloudDNSSpec
+	users   map[string]dyndnsUser
+	// One update at a time per hostname, so we don't race ourselves on the
+	// same record, but don't hold up everyone else while we're at it.
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newDyndnsServer(dnsSpec *CloudDNSSpec, users map[string]dyndnsUser) *dyndnsServer {
+	// Routers give up after a few seconds, so answer once Cloud DNS has
+	// the change rather than waiting for it to propagate.
+	spec := *dnsSpec
+	no_wait := 0
+	spec.change_wait_secs = &no_wait
+	return &dyndnsServer{dnsSpec: &spec, users: users, locks: map[string]*sync.Mutex{}}
+}
+
+func (s *dyndnsServer) hostnameLock(hostname string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.locks[hostname]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[hostname] = l
+	}
+	return l
+}
+
+func loadDyndnsUsers(filename string, domain string) (map[string]dyndnsUser, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	users := map[string]dyndnsUser{}
+	if err := yaml.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	for name, u := range users {
+		if u.Password == "" {
+			return nil, fmt.Errorf("%s: user %s has no password", filename, name)
+		}
+		for _, h := range u.Hostnames {
+			if !nameInZone(dyndnsName(h, domain), domain) {
+				return nil, fmt.Errorf("%s: user %s's hostname %s isn't in %s", filename, name, h, domain)
+			}
+		}
+	}
+	return users, nil
+}
+
+func dyndnsName(h string, domain string) string {
+	// Routers send fully qualified names without the trailing dot, but
+	// allow names relative to the zone too.
+	if n := normalizeName(h); nameInZone(n, domain) {
+		return n
+	}
+	return normalizeName(qualifyName(h, domain))
+}
+
+func (s *dyndnsServer) authenticate(r *http.Request) (dyndnsUser, bool) {
+	// The user r has good credentials for, if any.
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return dyndnsUser{}, false
+	}
+	u, ok := s.users[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(u.Password)) != 1 {
+		return dyndnsUser{}, false
+	}
+	return u, true
+}
+
+func (s *dyndnsServer) allowed(u dyndnsUser, hostname string) bool {
+	for _, h := range u.Hostnames {
+		if dyndnsName(h, *s.dnsSpec.domain) == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+func requestIP(r *http.Request) string {
+	// myip if given, otherwise whoever's asking.
+	if ip := r.URL.Query().Get("myip"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *dyndnsServer) update(hostname string, ip net.IP) string {
+	// Point hostname's A or AAAA record at ip, returning the dyndns2 result
+	// code.
+	l := s.hostnameLock(hostname)
+	l.Lock()
+	defer l.Unlock()
+
+	rtype := "AAAA"
+	if ip.To4() != nil {
+		rtype = "A"
+	}
+	current, err := getRrset(s.dnsSpec, hostname, rtype)
+	if err != nil {
+		log.Printf("dyndns: getting %s: %s", hostname, err)
+		return "dnserr"
+	}
+	if current != nil {
+		if len(current.Rrdatas) != 1 {
+			log.Printf("dyndns: %s has %d addresses, not updating it", hostname, len(current.Rrdatas))
+			return "dnserr"
+		}
+		if net.ParseIP(current.Rrdatas[0]).Equal(ip) {
+			return "nochg " + ip.String()
+		}
+	}
+
+	if err := updateOneRecord(s.dnsSpec, current, hostname, rtype, ip.String()); err != nil {
+		log.Printf("dyndns: updating %s: %s", hostname, err)
+		return "dnserr"
+	}
+	return "good " + ip.String()
+}
+
+func (s *dyndnsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// GET /nic/update?hostname=a,b&myip=1.2.3.4, as spoken by routers
+	// everywhere. One result line per hostname.
+	w.Header().Set("Content-Type", "text/plain")
+
+	user, ok := s.authenticate(r)
+	if !ok {
+		log.Printf("dyndns: bad credentials from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="clouddns-sync"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, "badauth")
+		dyndnsUpdates.WithLabelValues("badauth").Inc()
+		return
+	}
+
+	hostnames := strings.Split(r.URL.Query().Get("hostname"), ",")
+	ip := net.ParseIP(requestIP(r))
+
+	results := []string{}
+	for _, h := range hostnames {
+		h = strings.TrimSpace(h)
+		result := ""
+		switch {
+		case h == "":
+			result = "notfqdn"
+		case ip == nil:
+			result = "dnserr"
+		}
+		name := dyndnsName(h, *s.dnsSpec.domain)
+		if result == "" {
+			if s.allowed(user, name) {
+				result = s.update(name, ip)
+			} else {
+				result = "nohost"
+			}
+		}
+		log.Printf("dyndns: %s from %s: %s", h, r.RemoteAddr, result)
+		dyndnsUpdates.WithLabelValues(strings.Fields(result)[0]).Inc()
+		results = append(results, result)
+	}
+	fmt.Fprintln(w, strings.Join(results, "\n"))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func Test_dyndnsServer(t *testing.T) {
+	testDnsSpec, fake := newFakeCloudDnsSpec(t, []*dns.ResourceRecordSet{
+		{Name: "router.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}},
+	})
+
+	users_file := filepath.Join(t.TempDir(), "users.yaml")
+	os.WriteFile(users_file, []byte(`
+router:
+  password: hunter2
+  hostnames: [router, nas.mydomain.test.]
+other:
+  password: swordfish
+  hostnames: [other]
+`), 0600)
+	users, err := loadDyndnsUsers(users_file, *testDnsSpec.domain)
+	if err != nil {
+		t.Fatalf("loadDyndnsUsers() error = %v", err)
+	}
+	srv := newDyndnsServer(testDnsSpec, users)
+
+	tests := []struct {
+		name     string
+		query    string
+		user     string
+		password string
+		want     string
+	}{
+		{"no auth", "hostname=router.mydomain.test&myip=2.2.2.2", "", "", "badauth"},
+		{"bad password", "hostname=router.mydomain.test&myip=2.2.2.2", "router", "wrong", "badauth"},
+		{"bad password, several hosts", "hostname=router.mydomain.test,nas.mydomain.test&myip=2.2.2.2", "router", "wrong", "badauth"},
+		{"someone else's host", "hostname=router.mydomain.test&myip=2.2.2.2", "other", "swordfish", "nohost"},
+		{"unchanged", "hostname=router.mydomain.test&myip=1.1.1.1", "router", "hunter2", "nochg 1.1.1.1"},
+		{"changed", "hostname=router.mydomain.test&myip=2.2.2.2", "router", "hunter2", "good 2.2.2.2"},
+		{"new record from caller's address", "hostname=nas.mydomain.test", "router", "hunter2", "good 192.0.2.1"},
+		{"several at once", "hostname=router.mydomain.test,nas.mydomain.test,other.mydomain.test&myip=2.2.2.2", "router", "hunter2", "nochg 2.2.2.2\ngood 2.2.2.2\nnohost"},
+		{"ipv6 alongside ipv4", "hostname=router.mydomain.test&myip=2001:db8::1", "router", "hunter2", "good 2001:db8::1"},
+		{"ipv6 unchanged", "hostname=router.mydomain.test&myip=2001:db8:0::1", "router", "hunter2", "nochg 2001:db8::1"},
+		{"bad ip", "hostname=router.mydomain.test&myip=bogus", "router", "hunter2", "dnserr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/nic/update?"+tt.query, nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, r)
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("/nic/update?%s = %q, want %q", tt.query, got, tt.want)
+			}
+			if tt.want == "badauth" && w.Code != http.StatusUnauthorized {
+				t.Errorf("/nic/update with bad auth = %d, want 401", w.Code)
+			}
+		})
+	}
+
+	want := []*dns.ResourceRecordSet{
+		{Name: "router.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"2.2.2.2"}},
+		{Name: "nas.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"2.2.2.2"}},
+		{Name: "router.mydomain.test.", Type: "AAAA", Ttl: 300, Rrdatas: []string{"2001:db8::1"}},
+	}
+	if !rrsetListEquals(fake.rrs, want) {
+		for _, rr := range fake.rrs {
+			t.Logf("Got: %s", describeRrset(rr))
+		}
+		t.Errorf("zone after updates = %v, want %v", fake.rrs, want)
+	}
+}
+
+func Test_loadDyndnsUsersOutOfZone(t *testing.T) {
+	users_file := filepath.Join(t.TempDir(), "users.yaml")
+	os.WriteFile(users_file, []byte(`
+router:
+  password: hunter2
+  hostnames: [router, nas.elsewhere.test.]
+`), 0600)
+	if _, err := loadDyndnsUsers(users_file, "mydomain.test."); err == nil {
+		t.Errorf("loadDyndnsUsers() accepted a hostname outside the zone")
+	}
+}
+
+func Test_dyndnsServerLocking(t *testing.T) {
+	testDnsSpec, _ := newFakeCloudDnsSpec(t, nil)
+	wait_secs := 120
+	testDnsSpec.change_wait_secs = &wait_secs
+	srv := newDyndnsServer(testDnsSpec, map[string]dyndnsUser{
+		"router": {Password: "hunter2", Hostnames: []string{"router", "nas"}},
+	})
+	if *srv.dnsSpec.change_wait_secs != 0 || *testDnsSpec.change_wait_secs != 120 {
+		t.Errorf("dyndns server waits %ds for changes, want 0 (and the spec it was given left alone)", *srv.dnsSpec.change_wait_secs)
+	}
+
+	// An update stuck on one hostname doesn't hold up another.
+	stuck := srv.hostnameLock("router.mydomain.test.")
+	stuck.Lock()
+	defer stuck.Unlock()
+	done := make(chan string)
+	go func() {
+		r := httptest.NewRequest("GET", "/nic/update?hostname=nas&myip=2.2.2.2", nil)
+		r.SetBasicAuth("router", "hunter2")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		done <- strings.TrimSpace(w.Body.String())
+	}()
+	select {
+	case got := <-done:
+		if got != "good 2.2.2.2" {
+			t.Errorf("/nic/update for nas = %q, want %q", got, "good 2.2.2.2")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("/nic/update for nas waited on router's update")
+	}
+}
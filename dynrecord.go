@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"google.golang.org/api/dns/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// How soon to try again after a failed update. Doubles up to the usual
+// interval.
+var dynRecordRetryInterval = 30 * time.Second
+
+// What changed when we updated a dyn record, as sent to hooks.
+type dynRecordUpdate struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	OldIPs []string `json:"oldIps"`
+	NewIP  string   `json:"newIp"`
+}
+
+// Who to tell when a dyn record changes, if anyone.
+type dynRecordHooks struct {
+	// Run with sh -c, with the details in DYN_RECORD_* environment variables.
+	command string
+	// POSTed a dynRecordUpdate as JSON.
+	webhook string
+}
+
+// The record type holding addresses of each IP family.
+var familyRecordTypes = map[string]string{
+	"4": "A",
+	"6": "AAAA",
+}
+
+func ipFamilies(family string) ([]string, error) {
+	// --ip-family: 4, 6 or both.
+	switch family {
+	case "4", "6":
+		return []string{family}, nil
+	case "both":
+		return []string{"4", "6"}, nil
+	}
+	return nil, fmt.Errorf("unknown IP family %q, want 4, 6 or both", family)
+}
+
+// One record for dynrecord to keep pointed at us.
+//
+//   - name: home
+//     type: AAAA
+//     ttl: 60
+//     source: interface:eth0
+//   - name: vpn.otherdomain.tld.
+//     zone: otherzone
+type dynRecordSpec struct {
+	Name string `yaml:"name"`
+	// Defaults to --cloud-dns-zone.
+	Zone string `yaml:"zone"`
+	// A or AAAA, defaults to A.
+	Type string `yaml:"type"`
+	// Defaults to --cloud-dns-default-ttl.
+	Ttl int `yaml:"ttl"`
+	// Where our address comes from: "public" (the default, using
+	// --ip-detect) or "interface:<name>".
+	Source string `yaml:"source"`
+}
+
+func recordTypeFamily(rtype string) string {
+	for family, t := range familyRecordTypes {
+		if t == rtype {
+			return family
+		}
+	}
+	return ""
+}
+
+func loadDynRecords(filename string, dnsSpec *CloudDNSSpec) ([]*dynRecordSpec, error) {
+	// --dyn-records-file, with the defaults filled in.
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	records := []*dynRecordSpec{}
+	if err := yaml.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	for i, r := range records {
+		if r.Name == "" {
+			return nil, fmt.Errorf("%s: record %d has no name", filename, i+1)
+		}
+		if r.Zone == "" {
+			r.Zone = *dnsSpec.zone
+		}
+		r.Type = strings.ToUpper(r.Type)
+		if r.Type == "" {
+			r.Type = "A"
+		}
+		if recordTypeFamily(r.Type) == "" {
+			return nil, fmt.Errorf("%s: %s: type must be A or AAAA, not %s", filename, r.Name, r.Type)
+		}
+		if r.Ttl == 0 {
+			r.Ttl = *dnsSpec.default_ttl
+		}
+		if r.Source == "" {
+			r.Source = "public"
+		}
+		iface, is_iface := strings.CutPrefix(r.Source, "interface:")
+		if r.Source != "public" && (!is_iface || iface == "") {
+			return nil, fmt.Errorf("%s: %s: source must be public or interface:<name>, not %s", filename, r.Name, r.Source)
+		}
+	}
+	return records, nil
+}
+
+func dynRecordsFromFlags(dnsSpec *CloudDNSSpec, record_name string, families []string) []*dynRecordSpec {
+	// --cloud-dns-dyn-record-name and --ip-family, as if from a file.
+	ret := []*dynRecordSpec{}
+	for _, family := range families {
+		ret = append(ret, &dynRecordSpec{
+			Name:   record_name,
+			Zone:   *dnsSpec.zone,
+			Type:   familyRecordTypes[family],
+			Ttl:    *dnsSpec.default_ttl,
+			Source: "public",
+		})
+	}
+	return ret
+}
+
+func resolveDynRecordZones(dnsSpec *CloudDNSSpec, records []*dynRecordSpec) (map[string]*CloudDNSSpec, error) {
+	// A spec for each zone records are in, and each record's name fully
+	// qualified in its zone.
+	zones := map[string]*CloudDNSSpec{*dnsSpec.zone: dnsSpec}
+	seen := map[string]bool{}
+	for _, r := range records {
+		zoneSpec, ok := zones[r.Zone]
+		if !ok {
+			spec := *dnsSpec
+			zone := r.Zone
+			spec.zone = &zone
+			spec.domain = nil
+			if err := populateDnsSpec(&spec); err != nil {
+				return nil, err
+			}
+			zoneSpec = &spec
+			zones[r.Zone] = zoneSpec
+		}
+		r.Name = dyndnsName(r.Name, *zoneSpec.domain)
+		if !nameInZone(r.Name, *zoneSpec.domain) {
+			return nil, fmt.Errorf("%s isn't in zone %s (%s)", r.Name, r.Zone, *zoneSpec.domain)
+		}
+		key := r.Name + "/" + r.Type
+		if seen[key] {
+			return nil, fmt.Errorf("%s (%s) is listed more than once", r.Name, r.Type)
+		}
+		seen[key] = true
+	}
+	return zones, nil
+}
+
+func buildDynRecordChange(cloud_rrs []*dns.ResourceRecordSet, records []*dynRecordSpec, addrs map[*dynRecordSpec]string) (*dns.Change, []*dynRecordUpdate) {
+	// Replace each of records we've an address for, unless it's already
+	// just that address with the right TTL. Deletions are exactly what's in
+	// Cloud DNS now, TTL and all.
+	change := &dns.Change{}
+	updates := []*dynRecordUpdate{}
+	for _, r := range records {
+		ip, ok := addrs[r]
+		if !ok {
+			continue
+		}
+		want := &dns.ResourceRecordSet{Name: r.Name, Type: r.Type, Ttl: int64(r.Ttl), Rrdatas: []string{ip}}
+		update := &dynRecordUpdate{Name: r.Name, Type: r.Type, OldIPs: []string{}, NewIP: ip}
+		for _, c := range cloud_rrs {
+			if !sameRrsetKey(c, want) {
+				continue
+			}
+			if c.Ttl == want.Ttl && len(c.Rrdatas) == 1 && net.ParseIP(c.Rrdatas[0]).Equal(net.ParseIP(ip)) {
+				update = nil
+				break
+			}
+			if len(c.Rrdatas) > 1 {
+				log.Printf("%s (%s) has %d addresses, replacing them all with ours", r.Name, r.Type, len(c.Rrdatas))
+			}
+			update.OldIPs = c.Rrdatas
+			change.Deletions = append(change.Deletions, c)
+		}
+		if update == nil {
+			continue
+		}
+		change.Additions = append(change.Additions, want)
+		updates = append(updates, update)
+	}
+	return change, updates
+}
+
+func (h *dynRecordHooks) fire(u *dynRecordUpdate) {
+	// Failing hooks are logged, but don't fail the update, which has
+	// already happened.
+	if h.command != "" {
+		cmd := exec.Command("sh", "-c", h.command)
+		cmd.Env = append(os.Environ(),
+			"DYN_RECORD_NAME="+u.Name,
+			"DYN_RECORD_TYPE="+u.Type,
+			"DYN_RECORD_OLD_IP="+strings.Join(u.OldIPs, ","),
+			"DYN_RECORD_NEW_IP="+u.NewIP,
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Printf("Hook command for %s (%s) failed: %s: %s", u.Name, u.Type, err, bytes.TrimSpace(out))
+		}
+	}
+	if h.webhook != "" {
+		data, err := json.Marshal(u)
+		if err != nil {
+			log.Printf("Encoding webhook for %s (%s): %s", u.Name, u.Type, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "POST", h.webhook, bytes.NewReader(data))
+		if err != nil {
+			log.Printf("Webhook for %s (%s): %s", u.Name, u.Type, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("Webhook for %s (%s): %s", u.Name, u.Type, err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			log.Printf("Webhook for %s (%s): %s", u.Name, u.Type, res.Status)
+		}
+	}
+}
+
+func detectDynRecordAddrs(detectors []ipDetector, records []*dynRecordSpec) (map[*dynRecordSpec]string, map[*dynRecordSpec]error) {
+	// Our address for each of records, asking each source once per family.
+	type result struct {
+		ip  string
+		err error
+	}
+	detected := map[string]result{}
+	addrs := map[*dynRecordSpec]string{}
+	errs := map[*dynRecordSpec]error{}
+	for _, r := range records {
+		family := recordTypeFamily(r.Type)
+		key := r.Source + "/" + family
+		res, ok := detected[key]
+		if !ok {
+			sources := detectors
+			if name, ok := strings.CutPrefix(r.Source, "interface:"); ok {
+				// Whatever address it has: it may well be a VPN or LAN.
+				sources = []ipDetector{&interfaceDetector{name: name}}
+			}
+			res.ip, res.err = detectIP(sources, family)
+			if res.err == nil {
+				log.Printf("Detected IPv%s (%s): %s", family, r.Source, res.ip)
+			}
+			detected[key] = res
+		}
+		if res.err != nil {
+			errs[r] = fmt.Errorf("getting our IP: %s", res.err)
+			continue
+		}
+		addrs[r] = res.ip
+	}
+	return addrs, errs
+}
+
+func runDynRecords(zones map[string]*CloudDNSSpec, detectors []ipDetector, records []*dynRecordSpec, hooks *dynRecordHooks) int {
+	// Update all of records, with one change per zone, returning how many
+	// failed. Records are independent, so one failing (say there's no IPv6
+	// today) shouldn't stop the others.
+	addrs, errs := detectDynRecordAddrs(detectors, records)
+
+	zone_names := []string{}
+	by_zone := map[string][]*dynRecordSpec{}
+	for _, r := range records {
+		if _, ok := by_zone[r.Zone]; !ok {
+			zone_names = append(zone_names, r.Zone)
+		}
+		by_zone[r.Zone] = append(by_zone[r.Zone], r)
+	}
+
+	for _, zone := range zone_names {
+		zoneSpec := zones[zone]
+		updates := []*dynRecordUpdate{}
+		err := syncCloudDns(zoneSpec, func() (*dns.Change, error) {
+			// Just the rrsets we might change, not the whole zone.
+			cloud_rrs := []*dns.ResourceRecordSet{}
+			for _, r := range by_zone[zone] {
+				if _, ok := addrs[r]; !ok {
+					continue
+				}
+				current, err := getRrset(zoneSpec, r.Name, r.Type)
+				if err != nil {
+					log.Printf("Getting %s (%s): %s", r.Name, r.Type, err)
+					return nil, err
+				}
+				if current != nil {
+					cloud_rrs = append(cloud_rrs, current)
+				}
+			}
+			var change *dns.Change
+			change, updates = buildDynRecordChange(cloud_rrs, by_zone[zone], addrs)
+			return change, nil
+		})
+		if err != nil {
+			log.Printf("Updating dyn records in zone %s: %s", zone, err)
+			for _, r := range by_zone[zone] {
+				if _, ok := addrs[r]; ok {
+					errs[r] = err
+				}
+			}
+			continue
+		}
+		for _, u := range updates {
+			if !*zoneSpec.dry_run {
+				hooks.fire(u)
+			}
+		}
+		updated := map[string]bool{}
+		for _, u := range updates {
+			updated[u.Name+"/"+u.Type] = true
+		}
+		for _, r := range by_zone[zone] {
+			if _, ok := addrs[r]; !ok {
+				continue
+			}
+			if updated[r.Name+"/"+r.Type] {
+				dynRecordUpdates.WithLabelValues(r.Type, "updated").Inc()
+			} else {
+				dynRecordUpdates.WithLabelValues(r.Type, "unchanged").Inc()
+			}
+		}
+	}
+
+	for _, r := range records {
+		if err, ok := errs[r]; ok {
+			log.Printf("Updating %s (%s): %s", r.Name, r.Type, err)
+			dynRecordUpdates.WithLabelValues(r.Type, "error").Inc()
+		}
+	}
+	return len(errs)
+}
+
+func dynRecordWait(interval int, jitter int, failures int) time.Duration {
+	// interval seconds, plus up to jitter more so a fleet of us don't all
+	// turn up at once. Sooner after failures, backing off up to the usual.
+	wait := time.Duration(interval) * time.Second
+	if failures > 0 && dynRecordRetryInterval < wait {
+		wait = backoffDelay(dynRecordRetryInterval, wait, failures-1)
+	}
+	if jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(time.Duration(jitter) * time.Second)))
+	}
+	return wait
+}
+
+func periodicallyUpdateDynRecords(zones map[string]*CloudDNSSpec, detectors []ipDetector, records []*dynRecordSpec, hooks *dynRecordHooks, interval int, jitter int) {
+	failures := 0
+	for {
+		if runDynRecords(zones, detectors, records, hooks) > 0 {
+			failures++
+			log.Printf("Error updating dyn records (%d in a row)", failures)
+		} else {
+			failures = 0
+			dynRecordLastSuccess.Set(float64(time.Now().Unix()))
+		}
+		dynRecordConsecutiveFailures.Set(float64(failures))
+
+		wait := dynRecordWait(interval, jitter, failures)
+		log.Printf("Waiting %s.", wait.Round(time.Second))
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func Test_ipFamilies(t *testing.T) {
+	tests := []struct {
+		family  string
+		want    []string
+		wantErr bool
+	}{
+		{"4", []string{"4"}, false},
+		{"6", []string{"6"}, false},
+		{"both", []string{"4", "6"}, false},
+		{"", nil, true},
+		{"ipv4", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.family, func(t *testing.T) {
+			got, err := ipFamilies(tt.family)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ipFamilies(%q) error = %v, wantErr %v", tt.family, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ipFamilies(%q) = %v, want %v", tt.family, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runDynRecords_oneRecord(t *testing.T) {
+	tests := []struct {
+		name      string
+		rrs       []*dns.ResourceRecordSet
+		family    string
+		my_ip     string
+		want      []*dns.ResourceRecordSet
+		wantCalls int
+	}{
+		{
+			name:   "unchanged",
+			rrs:    []*dns.ResourceRecordSet{{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}}},
+			family: "4",
+			my_ip:  "192.0.2.1",
+			want:   []*dns.ResourceRecordSet{{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}}},
+		},
+		{
+			name:      "only the TTL changed",
+			rrs:       []*dns.ResourceRecordSet{{Name: "home.mydomain.test.", Type: "A", Ttl: 60, Rrdatas: []string{"192.0.2.1"}}},
+			family:    "4",
+			my_ip:     "192.0.2.1",
+			want:      []*dns.ResourceRecordSet{{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}}},
+			wantCalls: 1,
+		},
+		{
+			name:      "changed, with a TTL other than the default",
+			rrs:       []*dns.ResourceRecordSet{{Name: "home.mydomain.test.", Type: "A", Ttl: 60, Rrdatas: []string{"192.0.2.1"}}},
+			family:    "4",
+			my_ip:     "192.0.2.2",
+			want:      []*dns.ResourceRecordSet{{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.2"}}},
+			wantCalls: 1,
+		},
+		{
+			name:      "several addresses",
+			rrs:       []*dns.ResourceRecordSet{{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1", "192.0.2.2"}}},
+			family:    "4",
+			my_ip:     "192.0.2.2",
+			want:      []*dns.ResourceRecordSet{{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.2"}}},
+			wantCalls: 1,
+		},
+		{
+			name:   "new AAAA alongside the A",
+			rrs:    []*dns.ResourceRecordSet{{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}}},
+			family: "6",
+			my_ip:  "2001:db8::1",
+			want: []*dns.ResourceRecordSet{
+				{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}},
+				{Name: "home.mydomain.test.", Type: "AAAA", Ttl: 300, Rrdatas: []string{"2001:db8::1"}},
+			},
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDnsSpec, fake := newFakeCloudDnsSpec(t, tt.rrs)
+			records := dynRecordsFromFlags(testDnsSpec, "home.mydomain.test.", []string{tt.family})
+			zones := map[string]*CloudDNSSpec{"myzone": testDnsSpec}
+			if failed := runDynRecords(zones, []ipDetector{&fixedDetector{ip: tt.my_ip}}, records, &dynRecordHooks{}); failed != 0 {
+				t.Fatalf("runDynRecords() = %d failures, want 0", failed)
+			}
+			if len(fake.changes) != tt.wantCalls {
+				t.Errorf("runDynRecords() made %d changes, want %d", len(fake.changes), tt.wantCalls)
+			}
+			if !rrsetListEquals(fake.rrs, tt.want) {
+				t.Errorf("zone after update = %v, want %v", fake.rrs, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runDynRecords_hooks(t *testing.T) {
+	testDnsSpec, _ := newFakeCloudDnsSpec(t, []*dns.ResourceRecordSet{
+		{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}},
+		{Name: "home.mydomain.test.", Type: "AAAA", Ttl: 300, Rrdatas: []string{"2001:db8::1"}},
+	})
+
+	hook_out := filepath.Join(t.TempDir(), "hook.out")
+	var webhooks []dynRecordUpdate
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := dynRecordUpdate{}
+		json.NewDecoder(r.Body).Decode(&u)
+		webhooks = append(webhooks, u)
+	}))
+	t.Cleanup(srv.Close)
+	hooks := &dynRecordHooks{
+		command: `echo "$DYN_RECORD_NAME $DYN_RECORD_TYPE $DYN_RECORD_OLD_IP $DYN_RECORD_NEW_IP" >> ` + hook_out,
+		webhook: srv.URL,
+	}
+
+	updated := testutil.ToFloat64(dynRecordUpdates.WithLabelValues("A", "updated"))
+	unchanged := testutil.ToFloat64(dynRecordUpdates.WithLabelValues("AAAA", "unchanged"))
+	zones := map[string]*CloudDNSSpec{"myzone": testDnsSpec}
+	records := dynRecordsFromFlags(testDnsSpec, "home.mydomain.test.", []string{"4", "6"})
+	failed := runDynRecords(zones, []ipDetector{&fixedDetector{ip: "192.0.2.2"}}, records, hooks)
+
+	// Only the A record has an address to update it with.
+	if failed != 1 {
+		t.Errorf("runDynRecords() = %d failures, want 1", failed)
+	}
+	if got := testutil.ToFloat64(dynRecordUpdates.WithLabelValues("A", "updated")) - updated; got != 1 {
+		t.Errorf("dynrecord_updates_total{type=A,result=updated} went up by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(dynRecordUpdates.WithLabelValues("AAAA", "unchanged")) - unchanged; got != 0 {
+		t.Errorf("dynrecord_updates_total{type=AAAA,result=unchanged} went up by %v, want 0", got)
+	}
+
+	out, err := os.ReadFile(hook_out)
+	if err != nil {
+		t.Fatalf("hook command didn't run: %v", err)
+	}
+	if got, want := strings.TrimSpace(string(out)), "home.mydomain.test. A 192.0.2.1 192.0.2.2"; got != want {
+		t.Errorf("hook command saw %q, want %q", got, want)
+	}
+	want := []dynRecordUpdate{{Name: "home.mydomain.test.", Type: "A", OldIPs: []string{"192.0.2.1"}, NewIP: "192.0.2.2"}}
+	if !reflect.DeepEqual(webhooks, want) {
+		t.Errorf("webhook got %v, want %v", webhooks, want)
+	}
+
+	// Nothing changes the second time round, so no more hooks.
+	runDynRecords(zones, []ipDetector{&fixedDetector{ip: "192.0.2.2"}}, records[:1], hooks)
+	if len(webhooks) != 1 {
+		t.Errorf("webhook called %d times, want 1", len(webhooks))
+	}
+}
+
+func Test_loadDynRecords(t *testing.T) {
+	testDnsSpec, _ := newFakeCloudDnsSpec(t, nil)
+	tests := []struct {
+		name    string
+		yaml    string
+		want    []*dynRecordSpec
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			yaml: "- name: home\n",
+			want: []*dynRecordSpec{{Name: "home", Zone: "myzone", Type: "A", Ttl: 300, Source: "public"}},
+		},
+		{
+			name: "everything",
+			yaml: "- name: vpn.other.test.\n  zone: otherzone\n  type: aaaa\n  ttl: 60\n  source: interface:wg0\n",
+			want: []*dynRecordSpec{{Name: "vpn.other.test.", Zone: "otherzone", Type: "AAAA", Ttl: 60, Source: "interface:wg0"}},
+		},
+		{name: "no name", yaml: "- type: A\n", wantErr: true},
+		{name: "bad type", yaml: "- name: home\n  type: CNAME\n", wantErr: true},
+		{name: "bad source", yaml: "- name: home\n  source: carrier-pigeon\n", wantErr: true},
+		{name: "no interface", yaml: "- name: home\n  source: \"interface:\"\n", wantErr: true},
+		{name: "not a list", yaml: "name: home\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "dyn.yaml")
+			os.WriteFile(filename, []byte(tt.yaml), 0644)
+			got, err := loadDynRecords(filename, testDnsSpec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadDynRecords() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadDynRecords() = %+v, want %+v", got[0], tt.want[0])
+			}
+		})
+	}
+}
+
+func Test_runDynRecords_severalZones(t *testing.T) {
+	homeSpec, home := newFakeCloudDnsSpec(t, []*dns.ResourceRecordSet{
+		{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}},
+		{Name: "*.home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}},
+	})
+	otherSpec, other := newFakeCloudDnsSpec(t, nil)
+	other_zone := "otherzone"
+	other_domain := "other.test."
+	otherSpec.zone = &other_zone
+	otherSpec.domain = &other_domain
+	zones := map[string]*CloudDNSSpec{"myzone": homeSpec, "otherzone": otherSpec}
+
+	orig := interfaceAddrs
+	t.Cleanup(func() { interfaceAddrs = orig })
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		cidr := map[string]string{"eth0": "2001:db8::7/64", "wg0": "10.8.0.2/24"}[name]
+		ip, ipnet, _ := net.ParseCIDR(cidr)
+		ipnet.IP = ip
+		return []net.Addr{ipnet}, nil
+	}
+
+	records := []*dynRecordSpec{
+		{Name: "home.mydomain.test.", Zone: "myzone", Type: "A", Ttl: 300, Source: "public"},
+		{Name: "*.home.mydomain.test.", Zone: "myzone", Type: "A", Ttl: 300, Source: "public"},
+		{Name: "home.mydomain.test.", Zone: "myzone", Type: "AAAA", Ttl: 300, Source: "interface:eth0"},
+		{Name: "vpn.other.test.", Zone: "otherzone", Type: "A", Ttl: 60, Source: "public"},
+		// A VPN address, private but what's wanted here.
+		{Name: "wg.other.test.", Zone: "otherzone", Type: "A", Ttl: 60, Source: "interface:wg0"},
+	}
+	if failed := runDynRecords(zones, []ipDetector{&fixedDetector{ip: "192.0.2.2"}}, records, &dynRecordHooks{}); failed != 0 {
+		t.Fatalf("runDynRecords() = %d failures, want 0", failed)
+	}
+
+	// Only the records themselves are looked up, not the whole zone.
+	if home.zoneLists != 0 || other.zoneLists != 0 {
+		t.Errorf("runDynRecords() listed whole zones %d and %d times, want 0", home.zoneLists, other.zoneLists)
+	}
+	// One change per zone, however many records are in it.
+	if len(home.changes) != 1 || len(other.changes) != 1 {
+		t.Fatalf("runDynRecords() made %d and %d changes, want 1 per zone", len(home.changes), len(other.changes))
+	}
+	if got := len(home.changes[0].Additions); got != 3 {
+		t.Errorf("change to myzone has %d additions, want 3", got)
+	}
+	want_home := []*dns.ResourceRecordSet{
+		{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.2"}},
+		{Name: "*.home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.2"}},
+		{Name: "home.mydomain.test.", Type: "AAAA", Ttl: 300, Rrdatas: []string{"2001:db8::7"}},
+	}
+	if !rrsetListEquals(home.rrs, want_home) {
+		t.Errorf("myzone after update = %v, want %v", home.rrs, want_home)
+	}
+	want_other := []*dns.ResourceRecordSet{
+		{Name: "vpn.other.test.", Type: "A", Ttl: 60, Rrdatas: []string{"192.0.2.2"}},
+		{Name: "wg.other.test.", Type: "A", Ttl: 60, Rrdatas: []string{"10.8.0.2"}},
+	}
+	if !rrsetListEquals(other.rrs, want_other) {
+		t.Errorf("otherzone after update = %v, want %v", other.rrs, want_other)
+	}
+}
+
+func Test_resolveDynRecordZones(t *testing.T) {
+	testDnsSpec, _ := newFakeCloudDnsSpec(t, nil)
+	tests := []struct {
+		name    string
+		records []*dynRecordSpec
+		want    []string
+		wantErr bool
+	}{
+		{"relative and absolute", []*dynRecordSpec{{Name: "home", Zone: "myzone", Type: "A"}, {Name: "vpn.mydomain.test", Zone: "myzone", Type: "A"}}, []string{"home.mydomain.test.", "vpn.mydomain.test."}, false},
+		{"same name, different types", []*dynRecordSpec{{Name: "home", Zone: "myzone", Type: "A"}, {Name: "home", Zone: "myzone", Type: "AAAA"}}, []string{"home.mydomain.test.", "home.mydomain.test."}, false},
+		{"not in the zone", []*dynRecordSpec{{Name: "vpn.other.test.", Zone: "myzone", Type: "A"}}, nil, true},
+		{"twice", []*dynRecordSpec{{Name: "home", Zone: "myzone", Type: "A"}, {Name: "home.mydomain.test.", Zone: "myzone", Type: "A"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := resolveDynRecordZones(testDnsSpec, tt.records)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveDynRecordZones() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := []string{}
+			for _, r := range tt.records {
+				got = append(got, r.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveDynRecordZones() names = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dynRecordWait(t *testing.T) {
+	orig := dynRecordRetryInterval
+	t.Cleanup(func() { dynRecordRetryInterval = orig })
+	dynRecordRetryInterval = 30 * time.Second
+
+	tests := []struct {
+		name     string
+		interval int
+		jitter   int
+		failures int
+		min      time.Duration
+		max      time.Duration
+	}{
+		{"usual", 300, 0, 0, 300 * time.Second, 300 * time.Second},
+		{"jitter", 300, 60, 0, 300 * time.Second, 360 * time.Second},
+		// Backoff has up to 50% jitter of its own.
+		{"first failure", 300, 0, 1, 15 * time.Second, 30 * time.Second},
+		{"backing off", 300, 0, 3, 60 * time.Second, 120 * time.Second},
+		{"never longer than usual", 300, 0, 10, 150 * time.Second, 300 * time.Second},
+		{"interval shorter than retry", 10, 0, 1, 10 * time.Second, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dynRecordWait(tt.interval, tt.jitter, tt.failures)
+			if got < tt.min || got > tt.max {
+				t.Errorf("dynRecordWait(%d, %d, %d) = %s, want between %s and %s", tt.interval, tt.jitter, tt.failures, got, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -2,6 +2,18 @@
 
 set -e
 
+# dynrecord keeps itself going, with its own interval and backoff.
+if [ "$GCLOUD_VERB" = "dynrecord" ]; then
+  echo "Doing $GCLOUD_VERB for zone $GCLOUD_DNS_ZONE every $GCLOUD_DNS_INTERVAL_SECS seconds"
+  exec clouddns-sync \
+    --cloud-dns-zone=$GCLOUD_DNS_ZONE \
+    --cloud-dns-dyn-record-name=$GCLOUD_DYN_RECORD_NAME \
+    --json-keyfile=$JSON_KEYFILE \
+    --dyn-record-interval-secs=$GCLOUD_DNS_INTERVAL_SECS \
+    --http-port=$HTTP_PORT \
+    $GCLOUD_VERB
+fi
+
 while true
 do
   echo "Doing $GCLOUD_VERB for zone $GCLOUD_DNS_ZONE"
@@ -23,13 +35,6 @@ do
         -zonefilename=$ZONEFILENAME \
         $GCLOUD_VERB
               ;;
-    dynrecord)
-      clouddns-sync \
-        --cloud-dns-zone=$GCLOUD_DNS_ZONE \
-        --cloud-dns-dyn-record-name=$GCLOUD_DYN_RECORD_NAME \
-        --json-keyfile=$JSON_KEYFILE \
-        $GCLOUD_VERB
-              ;;
   esac
 
   echo "Sleeping for $GCLOUD_DNS_INTERVAL_SECS seconds..."
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"google.golang.org/api/dns/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats we can read and write zones in, via --format.
+var zoneFormats = []string{"zonefile", "json", "yaml", "octodns", "dnscontrol"}
+
+// Formats we only know how to read.
+var importOnlyZoneFormats = map[string]bool{"octodns": true, "dnscontrol": true}
+
+// A single rrset, as it appears in our JSON and YAML formats.
+// Field names follow the Cloud DNS API.
+type zoneRecord struct {
+	Name          string      `json:"name" yaml:"name"`
+	Type          string      `json:"type" yaml:"type"`
+	Ttl           int64       `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	Rrdatas       []string    `json:"rrdatas,omitempty" yaml:"rrdatas,omitempty"`
+	RoutingPolicy interface{} `json:"routingPolicy,omitempty" yaml:"routingPolicy,omitempty"`
+}
+
+func validZoneFormat(format string) bool {
+	for _, f := range zoneFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func stripKind(v interface{}) interface{} {
+	// Drop the API's 'kind' bookkeeping fields from a decoded JSON value.
+	switch t := v.(type) {
+	case map[string]interface{}:
+		ret := map[string]interface{}{}
+		for k, mv := range t {
+			if k != "kind" {
+				ret[k] = stripKind(mv)
+			}
+		}
+		return ret
+	case []interface{}:
+		ret := []interface{}{}
+		for _, sv := range t {
+			ret = append(ret, stripKind(sv))
+		}
+		return ret
+	}
+	return v
+}
+
+func routingPolicyValue(rp *dns.RRSetRoutingPolicy) interface{} {
+	// A routing policy as a plain map, suitable for comparing or writing out.
+	if rp == nil {
+		return nil
+	}
+	data, err := json.Marshal(rp)
+	if err != nil {
+		return nil
+	}
+	var ret interface{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil
+	}
+	return stripKind(ret)
+}
+
+func routingPoliciesEqual(x *dns.RRSetRoutingPolicy, y *dns.RRSetRoutingPolicy) bool {
+	return reflect.DeepEqual(routingPolicyValue(x), routingPolicyValue(y))
+}
+
+func rrsetsToZoneRecords(domain string, rrs []*dns.ResourceRecordSet) []zoneRecord {
+	ret := []zoneRecord{}
+	for _, rr := range zoneFileOrder(rrs, domain) {
+		n := normalizeRrset(rr)
+		ret = append(ret, zoneRecord{
+			Name:          n.Name,
+			Type:          n.Type,
+			Ttl:           n.Ttl,
+			Rrdatas:       n.Rrdatas,
+			RoutingPolicy: routingPolicyValue(n.RoutingPolicy),
+		})
+	}
+	return ret
+}
+
+func renderZone(dnsSpec *CloudDNSSpec, rrs []*dns.ResourceRecordSet, format string) (string, error) {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(rrsetsToZoneRecords(*dnsSpec.domain, rrs), "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data) + "\n", nil
+	case "yaml":
+		data, err := yaml.Marshal(rrsetsToZoneRecords(*dnsSpec.domain, rrs))
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case "zonefile":
+		return renderZonefile(*dnsSpec.domain, *dnsSpec.default_ttl, rrs), nil
+	}
+	if importOnlyZoneFormats[format] {
+		return "", fmt.Errorf("%s is an import-only format", format)
+	}
+	return "", fmt.Errorf("unknown zone format: %s", format)
+}
+
+func zoneRecordToRrset(dnsSpec *CloudDNSSpec, r zoneRecord) (*dns.ResourceRecordSet, error) {
+	if r.Type == "" {
+		return nil, fmt.Errorf("%s: record has no type", r.Name)
+	}
+	rr := &dns.ResourceRecordSet{
+		Name: qualifyName(r.Name, *dnsSpec.domain),
+		Type: strings.ToUpper(r.Type),
+		Ttl:  r.Ttl,
+	}
+	if r.Name == "" {
+		rr.Name = *dnsSpec.domain
+	}
+	if rr.Ttl == 0 {
+		rr.Ttl = int64(*dnsSpec.default_ttl)
+	}
+	for _, rd := range r.Rrdatas {
+		rr.Rrdatas = append(rr.Rrdatas, qualifyRdata(rr.Type, rd, *dnsSpec.domain))
+	}
+	if r.RoutingPolicy != nil {
+		// Round-trip through JSON to get the API's own type.
+		data, err := json.Marshal(r.RoutingPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("%s (%s): bad routingPolicy: %s", rr.Name, rr.Type, err)
+		}
+		rr.RoutingPolicy = &dns.RRSetRoutingPolicy{}
+		if err := json.Unmarshal(data, rr.RoutingPolicy); err != nil {
+			return nil, fmt.Errorf("%s (%s): bad routingPolicy: %s", rr.Name, rr.Type, err)
+		}
+	}
+	return rr, nil
+}
+
+func mergeRrsetIntoRrsets(dnsSpec *CloudDNSSpec, rrs []*dns.ResourceRecordSet, rr *dns.ResourceRecordSet) ([]*dns.ResourceRecordSet, string) {
+	// Add rr to rrs, merging it with any rrset of the same name and type,
+	// and skipping the records Cloud DNS manages itself. Returns a
+	// description of any TTL conflict along the way.
+	if rr.Type == "SOA" || (rr.Type == "NS" && normalizeName(rr.Name) == normalizeName(*dnsSpec.domain)) {
+		return rrs, ""
+	}
+	for _, existing := range rrs {
+		if sameRrsetKey(existing, rr) {
+			problem := ""
+			if existing.Ttl != rr.Ttl {
+				problem = fmt.Sprintf("%s (%s): conflicting TTLs %d and %d", rr.Name, rr.Type, existing.Ttl, rr.Ttl)
+				existing.Ttl = rr.Ttl
+			}
+			existing.Rrdatas = append(existing.Rrdatas, rr.Rrdatas...)
+			return rrs, problem
+		}
+	}
+	return append(rrs, rr), ""
+}
+
+func loadZoneRecordsRrsets(dnsSpec *CloudDNSSpec, data []byte, format string) ([]*dns.ResourceRecordSet, []string, error) {
+	records := []zoneRecord{}
+	var err error
+	if format == "yaml" {
+		err = yaml.Unmarshal(data, &records)
+	} else {
+		err = json.Unmarshal(data, &records)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return zoneRecordsToRrsets(dnsSpec, records, format)
+}
+
+func zoneRecordsToRrsets(dnsSpec *CloudDNSSpec, records []zoneRecord, format string) ([]*dns.ResourceRecordSet, []string, error) {
+	zone_rrs := []*dns.ResourceRecordSet{}
+	problems := []string{}
+	for _, r := range records {
+		rr, err := zoneRecordToRrset(dnsSpec, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		var problem string
+		zone_rrs, problem = mergeRrsetIntoRrsets(dnsSpec, zone_rrs, rr)
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	log.Printf("Processing %d %s records rendered %d rrsets", len(records), format, len(zone_rrs))
+
+	return zone_rrs, problems, nil
+}
+
+func loadZoneRrsets(dnsSpec *CloudDNSSpec, data []byte, format string) ([]*dns.ResourceRecordSet, []string, error) {
+	// Parse a zone in any of our formats into the rrsets buildDnsChange wants.
+	switch format {
+	case "zonefile":
+		return loadZonefileRrsets(dnsSpec, data)
+	case "json", "yaml":
+		return loadZoneRecordsRrsets(dnsSpec, data, format)
+	case "octodns":
+		return loadOctodnsRrsets(dnsSpec, data)
+	case "dnscontrol":
+		return loadDnscontrolRrsets(dnsSpec, data)
+	}
+	return nil, nil, fmt.Errorf("unknown zone format: %s", format)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func Test_renderZoneRoundTrip(t *testing.T) {
+	test_domain := "mydomain.test."
+	default_ttl := 300
+	testDnsSpec := &CloudDNSSpec{
+		default_ttl: &default_ttl,
+		domain:      &test_domain,
+	}
+
+	cloud_rrs := []*dns.ResourceRecordSet{
+		{Name: "mydomain.test.", Type: "SOA", Ttl: 21600, Rrdatas: []string{"ns1.example.com. root.example.com. 1 2 3 4 5"}},
+		{Name: "mydomain.test.", Type: "NS", Ttl: 21600, Rrdatas: []string{"ns1.example.com."}},
+		{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4", "5.6.7.8"}},
+		{Name: "www.mydomain.test.", Type: "TXT", Ttl: 60, Rrdatas: []string{`"v=spf1 -all"`}},
+		{Name: "mydomain.test.", Type: "MX", Ttl: 3600, Rrdatas: []string{"10 mail.mydomain.test."}},
+		{
+			Name: "geo.mydomain.test.",
+			Type: "A",
+			Ttl:  300,
+			RoutingPolicy: &dns.RRSetRoutingPolicy{
+				Kind: "dns#rRSetRoutingPolicy",
+				Geo: &dns.RRSetRoutingPolicyGeoPolicy{
+					Kind: "dns#rRSetRoutingPolicyGeoPolicy",
+					Items: []*dns.RRSetRoutingPolicyGeoPolicyGeoPolicyItem{
+						{Location: "europe-west1", Rrdatas: []string{"1.1.1.1"}},
+						{Location: "us-east1", Rrdatas: []string{"2.2.2.2"}},
+					},
+				},
+			},
+		},
+	}
+
+	for _, format := range []string{"json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			zone, err := renderZone(testDnsSpec, cloud_rrs, format)
+			if err != nil {
+				t.Fatalf("renderZone() error = %v", err)
+			}
+			t.Logf("Zone:\n%s", zone)
+
+			zone_rrs, problems, err := loadZoneRrsets(testDnsSpec, []byte(zone), format)
+			if err != nil {
+				t.Fatalf("loadZoneRrsets() error = %v", err)
+			}
+			if len(problems) != 0 {
+				t.Errorf("loadZoneRrsets() problems = %v", problems)
+			}
+
+			change := buildDnsChange(cloud_rrs, zone_rrs, true, *testDnsSpec.domain)
+			for _, rr := range change.Additions {
+				t.Logf("Addition: %s", describeRrset(rr))
+			}
+			for _, rr := range change.Deletions {
+				t.Logf("Deletion: %s", describeRrset(rr))
+			}
+			if len(change.Additions) != 0 || len(change.Deletions) != 0 {
+				t.Errorf("export then import as %s is not a no-op", format)
+			}
+		})
+	}
+}
+
+func Test_loadZoneRecordsRrsets(t *testing.T) {
+	test_domain := "mydomain.test."
+	default_ttl := 300
+	testDnsSpec := &CloudDNSSpec{
+		default_ttl: &default_ttl,
+		domain:      &test_domain,
+	}
+
+	zone := `
+- name: www
+  type: a
+  rrdatas: [1.2.3.4]
+- name: www
+  type: A
+  ttl: 60
+  rrdatas: [5.6.7.8]
+- name: ""
+  type: MX
+  ttl: 3600
+  rrdatas: ["10 mail"]
+- name: "@"
+  type: NS
+  rrdatas: [ns1.example.com.]
+- name: www
+  type: HTTPS
+  rrdatas: ["1 cdn alpn=h3", "2 . alpn=h2"]
+`
+	want := []*dns.ResourceRecordSet{
+		{Name: "www.mydomain.test.", Type: "A", Ttl: 60, Rrdatas: []string{"1.2.3.4", "5.6.7.8"}},
+		{Name: "www.mydomain.test.", Type: "HTTPS", Ttl: 300, Rrdatas: []string{"1 cdn.mydomain.test. alpn=h3", "2 . alpn=h2"}},
+		{Name: "mydomain.test.", Type: "MX", Ttl: 3600, Rrdatas: []string{"10 mail.mydomain.test."}},
+	}
+	wantProblems := []string{"www.mydomain.test. (A): conflicting TTLs 300 and 60"}
+
+	got, problems, err := loadZoneRrsets(testDnsSpec, []byte(zone), "yaml")
+	if err != nil {
+		t.Fatalf("loadZoneRrsets() error = %v", err)
+	}
+	if !rrsetListEquals(got, want) {
+		for _, rr := range want {
+			t.Logf("Want: %s", describeRrset(rr))
+		}
+		for _, rr := range got {
+			t.Logf("Got : %s", describeRrset(rr))
+		}
+		t.Errorf("loadZoneRrsets() = %v, want %v", got, want)
+	}
+	if len(problems) != 1 || problems[0] != wantProblems[0] {
+		t.Errorf("loadZoneRrsets() problems = %q, want %q", problems, wantProblems)
+	}
+}
+
+func Test_loadForeignRrsets(t *testing.T) {
+	test_domain := "mydomain.test."
+	default_ttl := 300
+	testDnsSpec := &CloudDNSSpec{
+		default_ttl: &default_ttl,
+		domain:      &test_domain,
+	}
+
+	octodns := `---
+'':
+  - type: A
+    values: [1.2.3.4, 5.6.7.8]
+  - type: MX
+    ttl: 3600
+    values:
+      - exchange: mx1.example.com.
+        preference: 10
+      - value: mx2.example.com.
+        priority: 20
+  - type: NS
+    values: [ns1.example.com.]
+  - type: CAA
+    value:
+      # flags defaults to 0
+      tag: issue
+      value: letsencrypt.org
+  - type: TXT
+    value: v=spf1 include:_spf.example.com \; -all
+www:
+  type: CNAME
+  value: mydomain.test.
+_sip._tcp:
+  type: SRV
+  ttl: 60
+  value:
+    priority: 10
+    weight: 20
+    port: 5060
+    target: sip.example.com.
+`
+
+	dnscontrol := `{
+  "registrars": [],
+  "dns_providers": [],
+  "domains": [
+    {
+      "name": "otherdomain.test",
+      "records": [{"type": "A", "name": "@", "target": "9.9.9.9", "ttl": 300}]
+    },
+    {
+      "name": "mydomain.test",
+      "records": [
+        {"type": "A", "name": "@", "target": "1.2.3.4", "ttl": 300},
+        {"type": "A", "name": "@", "target": "5.6.7.8", "ttl": 300},
+        {"type": "MX", "name": "@", "target": "mx1.example.com.", "mxpreference": 10, "ttl": 3600},
+        {"type": "MX", "name": "@", "target": "mx2.example.com.", "mxpreference": 20, "ttl": 3600},
+        {"type": "NS", "name": "@", "target": "ns1.example.com.", "ttl": 300},
+        {"type": "CAA", "name": "@", "target": "letsencrypt.org", "caatag": "issue", "caaflag": 0, "ttl": 300},
+        {"type": "TXT", "name": "@", "target": "v=spf1 include:_spf.example.com ; -all", "ttl": 300},
+        {"type": "CNAME", "name": "www", "target": "mydomain.test.", "ttl": 300},
+        {"type": "SRV", "name": "_sip._tcp", "target": "sip.example.com.", "srvpriority": 10, "srvweight": 20, "srvport": 5060, "ttl": 60}
+      ]
+    }
+  ]
+}`
+
+	want := []*dns.ResourceRecordSet{
+		{Name: "mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4", "5.6.7.8"}},
+		{Name: "mydomain.test.", Type: "MX", Ttl: 3600, Rrdatas: []string{"10 mx1.example.com.", "20 mx2.example.com."}},
+		{Name: "mydomain.test.", Type: "CAA", Ttl: 300, Rrdatas: []string{`0 issue "letsencrypt.org"`}},
+		{Name: "mydomain.test.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"v=spf1 include:_spf.example.com ; -all"`}},
+		{Name: "www.mydomain.test.", Type: "CNAME", Ttl: 300, Rrdatas: []string{"mydomain.test."}},
+		{Name: "_sip._tcp.mydomain.test.", Type: "SRV", Ttl: 60, Rrdatas: []string{"10 20 5060 sip.example.com."}},
+	}
+
+	for format, data := range map[string]string{"octodns": octodns, "dnscontrol": dnscontrol} {
+		t.Run(format, func(t *testing.T) {
+			got, problems, err := loadZoneRrsets(testDnsSpec, []byte(data), format)
+			if err != nil {
+				t.Fatalf("loadZoneRrsets() error = %v", err)
+			}
+			if len(problems) != 0 {
+				t.Errorf("loadZoneRrsets() problems = %v", problems)
+			}
+			if !rrsetListEquals(got, want) {
+				for _, rr := range want {
+					t.Logf("Want: %s", describeRrset(rr))
+				}
+				for _, rr := range got {
+					t.Logf("Got : %s", describeRrset(rr))
+				}
+				t.Errorf("loadZoneRrsets() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_loadOctodnsUnsupportedType(t *testing.T) {
+	test_domain := "mydomain.test."
+	default_ttl := 300
+	testDnsSpec := &CloudDNSSpec{
+		default_ttl: &default_ttl,
+		domain:      &test_domain,
+	}
+
+	_, _, err := loadZoneRrsets(testDnsSpec, []byte("'':\n  type: ALIAS\n  value: example.com.\n"), "octodns")
+	if err == nil {
+		t.Errorf("loadZoneRrsets() accepted an ALIAS record")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func writeFileAtomically(filename string, data []byte) error {
+	// Write to a temp file next to the target and rename it into place, so
+	// readers never see a half-written zonefile.
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// Keep the mode of the file we're replacing, CreateTemp makes it 0600.
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("git %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func commitFileToGit(filename string, message string) error {
+	// Commit just this file to whatever git repository it lives in.
+	// Does nothing if the file hasn't changed since the last commit.
+	dir := filepath.Dir(filename)
+	base := filepath.Base(filename)
+
+	if _, err := runGit(dir, "add", "--", base); err != nil {
+		return err
+	}
+
+	// diff --quiet exits 1 if there are differences.
+	if _, err := runGit(dir, "diff", "--cached", "--quiet", "--", base); err == nil {
+		log.Printf("%s unchanged, nothing to commit", filename)
+		return nil
+	}
+
+	if _, err := runGit(dir, "commit", "--quiet", "-m", message, "--", base); err != nil {
+		return err
+	}
+	log.Printf("Committed %s", filename)
+	return nil
+}
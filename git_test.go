@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_writeFileAtomically(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		existing os.FileMode
+		want     os.FileMode
+	}{
+		{"new file", 0, 0644},
+		{"private file", 0600, 0600},
+		{"group writable", 0664, 0664},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "_")+".zone")
+			if tt.existing != 0 {
+				os.WriteFile(filename, []byte("old\n"), tt.existing)
+				os.Chmod(filename, tt.existing)
+			}
+			if err := writeFileAtomically(filename, []byte("new\n")); err != nil {
+				t.Fatalf("writeFileAtomically() error = %v", err)
+			}
+			fi, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != tt.want {
+				t.Errorf("writeFileAtomically() left mode %v, want %v", fi.Mode().Perm(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_commitFileToGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"config", "user.name", "test"},
+		{"config", "user.email", "test@example.com"},
+	} {
+		if _, err := runGit(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filename := filepath.Join(dir, "myzone.zone")
+
+	commits := func() int {
+		out, err := runGit(dir, "rev-list", "--all", "--count")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(out))
+		return n
+	}
+
+	// First export gets committed.
+	if err := writeFileAtomically(filename, []byte("www IN A 1.2.3.4\n")); err != nil {
+		t.Fatalf("writeFileAtomically() error = %v", err)
+	}
+	if err := commitFileToGit(filename, "first"); err != nil {
+		t.Fatalf("commitFileToGit() error = %v", err)
+	}
+	if got := commits(); got != 1 {
+		t.Errorf("after first export, %d commits, want 1", got)
+	}
+
+	// Same content again is a no-op.
+	if err := writeFileAtomically(filename, []byte("www IN A 1.2.3.4\n")); err != nil {
+		t.Fatalf("writeFileAtomically() error = %v", err)
+	}
+	if err := commitFileToGit(filename, "second"); err != nil {
+		t.Fatalf("commitFileToGit() error = %v", err)
+	}
+	if got := commits(); got != 1 {
+		t.Errorf("after unchanged export, %d commits, want 1", got)
+	}
+
+	// A change gets its own commit, with our message.
+	if err := writeFileAtomically(filename, []byte("www IN A 5.6.7.8\n")); err != nil {
+		t.Fatalf("writeFileAtomically() error = %v", err)
+	}
+	if err := commitFileToGit(filename, "third"); err != nil {
+		t.Fatalf("commitFileToGit() error = %v", err)
+	}
+	if got := commits(); got != 2 {
+		t.Errorf("after changed export, %d commits, want 2", got)
+	}
+	if out, _ := runGit(dir, "log", "-1", "--format=%s"); strings.TrimSpace(out) != "third" {
+		t.Errorf("last commit message = %q, want 'third'", out)
+	}
+
+	// No temp files left lying around.
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() != ".git" && e.Name() != "myzone.zone" {
+			t.Errorf("unexpected file left behind: %s", e.Name())
+		}
+	}
+}
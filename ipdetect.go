@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A way of finding out our public address.
+type ipDetector interface {
+	// Our address in family, "4" or "6".
+	DetectIP(ctx context.Context, family string) (net.IP, error)
+	String() string
+}
+
+// How long any one detector gets before we move on to the next.
+var ipDetectTimeout = 30 * time.Second
+
+// What --ip-detect and friends configure, see newIPDetectors().
+type ipDetectSpec struct {
+	methods        *string
+	urls           *string
+	quorum         *int
+	stun_server    *string
+	dns_server     *string
+	iface          *string
+	natpmp_gateway *string
+}
+
+func isFamily(ip net.IP, family string) bool {
+	if family == "4" {
+		return ip.To4() != nil
+	}
+	return ip.To4() == nil && ip.To16() != nil
+}
+
+func newIPDetectors(spec *ipDetectSpec) ([]ipDetector, error) {
+	// One detector per --ip-detect method, to be tried in that order.
+	ret := []ipDetector{}
+	for _, method := range strings.Split(*spec.methods, ",") {
+		switch strings.TrimSpace(method) {
+		case "https":
+			urls := []string{}
+			for _, u := range strings.Split(*spec.urls, ",") {
+				if u = strings.TrimSpace(u); u != "" {
+					urls = append(urls, u)
+				}
+			}
+			if *spec.quorum < 1 || *spec.quorum > len(urls) {
+				return nil, fmt.Errorf("quorum of %d can't be met by %d URLs", *spec.quorum, len(urls))
+			}
+			ret = append(ret, &httpsDetector{urls: urls, quorum: *spec.quorum})
+		case "stun":
+			ret = append(ret, &stunDetector{server: *spec.stun_server})
+		case "dns":
+			servers := openDNSResolvers
+			if *spec.dns_server != "" {
+				servers = map[string]string{"4": *spec.dns_server, "6": *spec.dns_server}
+			}
+			ret = append(ret, &dnsDetector{name: "myip.opendns.com.", servers: servers})
+		case "interface":
+			if *spec.iface == "" {
+				return nil, fmt.Errorf("--ip-detect-interface is required for the interface method")
+			}
+			ret = append(ret, &interfaceDetector{name: *spec.iface, publicOnly: true})
+		case "natpmp":
+			if *spec.natpmp_gateway == "" {
+				return nil, fmt.Errorf("--ip-detect-natpmp-gateway is required for the natpmp method")
+			}
+			ret = append(ret, &natpmpDetector{gateway: *spec.natpmp_gateway})
+		default:
+			return nil, fmt.Errorf("unknown IP detection method %q, want https, stun, dns, interface or natpmp", method)
+		}
+	}
+	return ret, nil
+}
+
+func detectIP(detectors []ipDetector, family string) (string, error) {
+	// Our address in family, from the first detector that knows it.
+	errs := []string{}
+	for _, d := range detectors {
+		ctx, cancel := context.WithTimeout(context.Background(), ipDetectTimeout)
+		ip, err := d.DetectIP(ctx, family)
+		cancel()
+		if err == nil && !isFamily(ip, family) {
+			err = fmt.Errorf("got %s, which isn't IPv%s", ip, family)
+		}
+		if err != nil {
+			log.Printf("Detecting IPv%s with %s: %s", family, d, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", d, err))
+			continue
+		}
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("no way of detecting our IPv%s worked (%s)", family, strings.Join(errs, "; "))
+}
+
+// Ask some HTTPS "what's my IP" services, and believe them if at least
+// quorum agree.
+type httpsDetector struct {
+	urls   []string
+	quorum int
+	// For tests, to trust their servers.
+	tlsConfig *tls.Config
+
+	// One client per family, so connections get reused between checks.
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+func (d *httpsDetector) String() string {
+	return "https"
+}
+
+func (d *httpsDetector) client(family string) *http.Client {
+	// Only ever over family, so a dual-stack host gets the right answer.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c, ok := d.clients[family]; ok {
+		return c
+	}
+	if d.clients == nil {
+		d.clients = map[string]*http.Client{}
+	}
+	dialer := &net.Dialer{}
+	d.clients[family] = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "tcp"+family, addr)
+			},
+			TLSClientConfig: d.tlsConfig,
+		},
+	}
+	return d.clients[family]
+}
+
+func (d *httpsDetector) get(ctx context.Context, family string, url string) (net.IP, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := d.client(family).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", res.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("non-IP returned: %q", body)
+	}
+	return ip, nil
+}
+
+func (d *httpsDetector) DetectIP(ctx context.Context, family string) (net.IP, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	votes := map[string]int{}
+	answers := []string{}
+	for _, url := range d.urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			ip, err := d.get(ctx, family, url)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				answers = append(answers, fmt.Sprintf("%s: %s", url, err))
+				return
+			}
+			votes[ip.String()]++
+			answers = append(answers, fmt.Sprintf("%s: %s", url, ip))
+		}(url)
+	}
+	wg.Wait()
+
+	// A tie for most votes means we can't tell which answer is right.
+	best, tied := "", false
+	for ip, n := range votes {
+		switch {
+		case best == "" || n > votes[best]:
+			best, tied = ip, false
+		case n == votes[best]:
+			tied = true
+		}
+	}
+	sort.Strings(answers)
+	if best == "" || votes[best] < d.quorum {
+		return nil, fmt.Errorf("fewer than %d of %d services agree (%s)", d.quorum, len(d.urls), strings.Join(answers, ", "))
+	}
+	if tied {
+		return nil, fmt.Errorf("services disagree (%s)", strings.Join(answers, ", "))
+	}
+	return net.ParseIP(best), nil
+}
+
+// Ask a STUN server what address our packets come from (RFC 5389).
+type stunDetector struct {
+	server string
+}
+
+const (
+	stunMagicCookie          = 0x2112A442
+	stunBindingRequest       = 0x0001
+	stunBindingSuccess       = 0x0101
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+)
+
+func (d *stunDetector) String() string {
+	return "stun " + d.server
+}
+
+func parseStunResponse(msg []byte, txid []byte) (net.IP, error) {
+	if len(msg) < 20 {
+		return nil, fmt.Errorf("short STUN response")
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != stunBindingSuccess {
+		return nil, fmt.Errorf("STUN response type %#04x, not binding success", binary.BigEndian.Uint16(msg[0:2]))
+	}
+	if binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie || string(msg[8:20]) != string(txid) {
+		return nil, fmt.Errorf("STUN response isn't for our request")
+	}
+	attrs := msg[20:]
+	if length := int(binary.BigEndian.Uint16(msg[2:4])); length <= len(attrs) {
+		attrs = attrs[:length]
+	}
+
+	var mapped net.IP
+	for len(attrs) >= 4 {
+		atype := binary.BigEndian.Uint16(attrs[0:2])
+		alen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+alen > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+alen]
+		// Attributes are padded to 4 bytes.
+		attrs = attrs[min(len(attrs), 4+(alen+3)&^3):]
+		if len(value) < 8 {
+			continue
+		}
+		addr := make([]byte, len(value)-4)
+		copy(addr, value[4:])
+		if len(addr) != net.IPv4len && len(addr) != net.IPv6len {
+			continue
+		}
+		switch atype {
+		case stunAttrXorMappedAddress:
+			// XORed with the magic cookie, then the transaction ID.
+			key := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+			key = append(key, txid...)
+			for i := range addr {
+				addr[i] ^= key[i]
+			}
+			return net.IP(addr), nil
+		case stunAttrMappedAddress:
+			mapped = net.IP(addr)
+		}
+	}
+	if mapped == nil {
+		return nil, fmt.Errorf("no mapped address in STUN response")
+	}
+	return mapped, nil
+}
+
+func (d *stunDetector) DetectIP(ctx context.Context, family string) (net.IP, error) {
+	txid := make([]byte, 12)
+	if _, err := rand.Read(txid); err != nil {
+		return nil, err
+	}
+	req := binary.BigEndian.AppendUint16(nil, stunBindingRequest)
+	req = binary.BigEndian.AppendUint16(req, 0)
+	req = binary.BigEndian.AppendUint32(req, stunMagicCookie)
+	req = append(req, txid...)
+
+	resp, err := udpRoundTrip(ctx, "udp"+family, d.server, req)
+	if err != nil {
+		return nil, err
+	}
+	return parseStunResponse(resp, txid)
+}
+
+func udpRoundTrip(ctx context.Context, network string, server string, req []byte) ([]byte, error) {
+	// Send req until we get something back, backing off between tries
+	// like STUN and NAT-PMP both ask us to.
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	wait := 250 * time.Millisecond
+	buf := make([]byte, 1500)
+	for {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(wait)
+		if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+			deadline = dl
+		}
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		if err == nil {
+			return buf[:n], nil
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("no answer from %s", server)
+		}
+		wait *= 2
+	}
+}
+
+// OpenDNS's resolvers tell you your own address if you ask for
+// myip.opendns.com, as long as you ask over the family you want to know.
+var openDNSResolvers = map[string]string{
+	"4": "208.67.222.222:53",
+	"6": "[2620:119:35::35]:53",
+}
+
+// Ask a nameserver that answers with the address asking.
+type dnsDetector struct {
+	name    string
+	servers map[string]string
+}
+
+func (d *dnsDetector) String() string {
+	return "dns " + d.name
+}
+
+func (d *dnsDetector) DetectIP(ctx context.Context, family string) (net.IP, error) {
+	rrset, err := queryNameserver(ctx, d.servers[family], d.name, familyRecordTypes[family])
+	if err != nil {
+		return nil, err
+	}
+	if len(rrset.Rrdatas) != 1 {
+		return nil, fmt.Errorf("%s gave %d answers for %s", d.servers[family], len(rrset.Rrdatas), d.name)
+	}
+	return net.ParseIP(rrset.Rrdatas[0]), nil
+}
+
+// Addresses of a network interface, by name. A variable for tests.
+var interfaceAddrs = func(name string) ([]net.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return iface.Addrs()
+}
+
+// Read the address straight off a local interface, for when we're the
+// thing with the public address.
+type interfaceDetector struct {
+	name string
+	// Only addresses reachable from anywhere, not RFC 1918/ULA ones.
+	publicOnly bool
+}
+
+func (d *interfaceDetector) String() string {
+	return "interface " + d.name
+}
+
+func (d *interfaceDetector) DetectIP(ctx context.Context, family string) (net.IP, error) {
+	addrs, err := interfaceAddrs(d.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		// Skip link-local and loopback addresses, and RFC 1918/ULA ones
+		// if nobody outside should need to reach us.
+		ip := ipnet.IP
+		if isFamily(ip, family) && ip.IsGlobalUnicast() && !(d.publicOnly && ip.IsPrivate()) {
+			return ip, nil
+		}
+	}
+	if d.publicOnly {
+		return nil, fmt.Errorf("no public IPv%s address on %s", family, d.name)
+	}
+	return nil, fmt.Errorf("no IPv%s address on %s", family, d.name)
+}
+
+// Ask the gateway for its external address with NAT-PMP (RFC 6886).
+type natpmpDetector struct {
+	// host, or host:port if not the usual 5351.
+	gateway string
+}
+
+func (d *natpmpDetector) String() string {
+	return "natpmp " + d.gateway
+}
+
+func parseNatpmpResponse(msg []byte) (net.IP, error) {
+	if len(msg) < 12 || msg[0] != 0 || msg[1] != 128 {
+		return nil, fmt.Errorf("not a NAT-PMP external address response")
+	}
+	if code := binary.BigEndian.Uint16(msg[2:4]); code != 0 {
+		return nil, fmt.Errorf("NAT-PMP result code %d", code)
+	}
+	return net.IPv4(msg[8], msg[9], msg[10], msg[11]), nil
+}
+
+func (d *natpmpDetector) DetectIP(ctx context.Context, family string) (net.IP, error) {
+	if family != "4" {
+		return nil, fmt.Errorf("NAT-PMP only knows about IPv4")
+	}
+	server := d.gateway
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "5351")
+	}
+	// Version 0, opcode 0: what's your external address?
+	resp, err := udpRoundTrip(ctx, "udp4", server, []byte{0, 0})
+	if err != nil {
+		return nil, err
+	}
+	return parseNatpmpResponse(resp)
+}
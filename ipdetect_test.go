@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A local UDP server answering each packet with reply(packet).
+func startUDPStandIn(t *testing.T, reply func([]byte) []byte) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := reply(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func Test_newIPDetectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods string
+		quorum  int
+		iface   string
+		want    []string
+		wantErr bool
+	}{
+		{"default", "https", 2, "", []string{"https"}, false},
+		{"fallbacks in order", "stun, dns,https", 2, "", []string{"stun stun.test:3478", "dns myip.opendns.com.", "https"}, false},
+		{"interface", "interface", 2, "eth0", []string{"interface eth0"}, false},
+		{"interface without one", "interface", 2, "", nil, true},
+		{"natpmp without gateway", "natpmp", 2, "", nil, true},
+		{"quorum too big", "https", 4, "", nil, true},
+		{"unknown", "carrier-pigeon", 2, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urls := "https://a.test,https://b.test,https://c.test"
+			stun_server := "stun.test:3478"
+			empty := ""
+			got, err := newIPDetectors(&ipDetectSpec{
+				methods:        &tt.methods,
+				urls:           &urls,
+				quorum:         &tt.quorum,
+				stun_server:    &stun_server,
+				dns_server:     &empty,
+				iface:          &tt.iface,
+				natpmp_gateway: &empty,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newIPDetectors() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			names := []string{}
+			for _, d := range got {
+				names = append(names, d.String())
+			}
+			if !tt.wantErr && strings.Join(names, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("newIPDetectors() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func Test_httpsDetector(t *testing.T) {
+	// Each server answers with its own fixed body.
+	newServer := func(body string) *httptest.Server {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if body == "" {
+				http.Error(w, "down", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintln(w, body)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	tests := []struct {
+		name    string
+		bodies  []string
+		quorum  int
+		want    string
+		wantErr bool
+	}{
+		{"all agree", []string{"203.0.113.7", "203.0.113.7", "203.0.113.7"}, 2, "203.0.113.7", false},
+		{"one liar", []string{"203.0.113.7", "198.51.100.1", "203.0.113.7"}, 2, "203.0.113.7", false},
+		{"one down", []string{"203.0.113.7", "", "203.0.113.7"}, 2, "203.0.113.7", false},
+		{"no consensus", []string{"203.0.113.7", "198.51.100.1", ""}, 2, "", true},
+		{"garbage", []string{"<html>oops</html>", "203.0.113.7"}, 2, "", true},
+		{"quorum of one", []string{"203.0.113.7"}, 1, "203.0.113.7", false},
+		{"quorum of one, outvoted", []string{"198.51.100.1", "203.0.113.7", "203.0.113.7"}, 1, "203.0.113.7", false},
+		{"quorum of one, disagreeing", []string{"203.0.113.7", "198.51.100.1"}, 1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &httpsDetector{quorum: tt.quorum}
+			for _, body := range tt.bodies {
+				srv := newServer(body)
+				d.urls = append(d.urls, srv.URL)
+				d.tlsConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+			}
+			// Twice, the second time over the first time's connections.
+			for i := 0; i < 2; i++ {
+				got, err := d.DetectIP(context.Background(), "4")
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("DetectIP() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if !tt.wantErr && got.String() != tt.want {
+					t.Errorf("DetectIP() = %s, want %s", got, tt.want)
+				}
+			}
+			if len(d.clients) != 1 {
+				t.Errorf("DetectIP() made %d clients, want 1", len(d.clients))
+			}
+		})
+	}
+}
+
+func Test_stunDetector(t *testing.T) {
+	mapped := net.ParseIP("203.0.113.7").To4()
+	server := startUDPStandIn(t, func(req []byte) []byte {
+		if len(req) != 20 || binary.BigEndian.Uint16(req[0:2]) != stunBindingRequest {
+			return nil
+		}
+		// A software attribute to skip over, then XOR-MAPPED-ADDRESS.
+		attrs := binary.BigEndian.AppendUint16(nil, 0x8022)
+		attrs = binary.BigEndian.AppendUint16(attrs, 5)
+		attrs = append(attrs, 't', 'e', 's', 't', 's', 0, 0, 0)
+		attrs = binary.BigEndian.AppendUint16(attrs, stunAttrXorMappedAddress)
+		attrs = binary.BigEndian.AppendUint16(attrs, 8)
+		attrs = append(attrs, 0, 1, 0x21^0x12, 0x12^0x34)
+		for i, b := range mapped {
+			attrs = append(attrs, b^req[4+i])
+		}
+		resp := binary.BigEndian.AppendUint16(nil, stunBindingSuccess)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(attrs)))
+		resp = append(resp, req[4:20]...)
+		return append(resp, attrs...)
+	})
+
+	d := &stunDetector{server: server}
+	got, err := d.DetectIP(context.Background(), "4")
+	if err != nil {
+		t.Fatalf("DetectIP() error = %v", err)
+	}
+	if !got.Equal(mapped) {
+		t.Errorf("DetectIP() = %s, want %s", got, mapped)
+	}
+}
+
+func Test_parseStunResponse(t *testing.T) {
+	txid := []byte("abcdefghijkl")
+	header := func(rtype uint16, attrs []byte) []byte {
+		msg := binary.BigEndian.AppendUint16(nil, rtype)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(attrs)))
+		msg = binary.BigEndian.AppendUint32(msg, stunMagicCookie)
+		msg = append(msg, txid...)
+		return append(msg, attrs...)
+	}
+	// Plain MAPPED-ADDRESS, as old servers send.
+	mapped := []byte{0, 1, 0, 8, 0, 1, 0x0d, 0x05, 198, 51, 100, 1}
+	// XOR-MAPPED-ADDRESS for 2001:db8::1.
+	xor6 := []byte{0, 0x20, 0, 20, 0, 2, 0, 0}
+	key := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+	key = append(key, txid...)
+	for i, b := range net.ParseIP("2001:db8::1") {
+		xor6 = append(xor6, b^key[i])
+	}
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    string
+		wantErr bool
+	}{
+		{"mapped address", header(stunBindingSuccess, mapped), "198.51.100.1", false},
+		{"xor mapped ipv6", header(stunBindingSuccess, xor6), "2001:db8::1", false},
+		{"xor preferred", header(stunBindingSuccess, append(append([]byte{}, mapped...), xor6...)), "2001:db8::1", false},
+		{"error response", header(0x0111, nil), "", true},
+		{"no address", header(stunBindingSuccess, nil), "", true},
+		{"short", []byte{1, 1, 0}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStunResponse(tt.msg, txid)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStunResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("parseStunResponse() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dnsDetector(t *testing.T) {
+	name := dnsmessage.MustNewName("myip.opendns.com.")
+	ns := startTestNameserver(t, func() []dnsmessage.Resource {
+		return []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA}, Body: &dnsmessage.AResource{A: [4]byte{203, 0, 113, 7}}},
+			{Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeAAAA}, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}},
+		}
+	})
+	d := &dnsDetector{name: "myip.opendns.com.", servers: map[string]string{"4": ns, "6": ns}}
+
+	for family, want := range map[string]string{"4": "203.0.113.7", "6": "2001:db8::1"} {
+		got, err := d.DetectIP(context.Background(), family)
+		if err != nil {
+			t.Fatalf("DetectIP(%s) error = %v", family, err)
+		}
+		if got.String() != want {
+			t.Errorf("DetectIP(%s) = %s, want %s", family, got, want)
+		}
+	}
+}
+
+func Test_interfaceDetector(t *testing.T) {
+	orig := interfaceAddrs
+	t.Cleanup(func() { interfaceAddrs = orig })
+	ifaces := map[string][]string{
+		"eth0": {"127.0.0.1/8", "192.168.1.2/24", "fe80::1/64", "fd00::2/64", "203.0.113.7/24", "2001:db8::7/64"},
+		"wg0":  {"fe80::2/64", "10.8.0.2/24", "fd00::8:2/64"},
+	}
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		cidrs, ok := ifaces[name]
+		if !ok {
+			return nil, fmt.Errorf("no such interface")
+		}
+		ret := []net.Addr{}
+		for _, cidr := range cidrs {
+			ip, ipnet, _ := net.ParseCIDR(cidr)
+			ipnet.IP = ip
+			ret = append(ret, ipnet)
+		}
+		return ret, nil
+	}
+
+	tests := []struct {
+		iface      string
+		publicOnly bool
+		family     string
+		want       string
+		wantErr    bool
+	}{
+		{"eth0", true, "4", "203.0.113.7", false},
+		{"eth0", true, "6", "2001:db8::7", false},
+		{"eth0", false, "4", "192.168.1.2", false},
+		{"wg0", true, "4", "", true},
+		{"wg0", false, "4", "10.8.0.2", false},
+		{"wg0", false, "6", "fd00::8:2", false},
+		{"wlan0", false, "4", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s/public=%v", tt.iface, tt.family, tt.publicOnly), func(t *testing.T) {
+			d := &interfaceDetector{name: tt.iface, publicOnly: tt.publicOnly}
+			got, err := d.DetectIP(context.Background(), tt.family)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DetectIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("DetectIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_natpmpDetector(t *testing.T) {
+	var result atomic.Uint32
+	gateway := startUDPStandIn(t, func(req []byte) []byte {
+		if len(req) != 2 || req[0] != 0 || req[1] != 0 {
+			return nil
+		}
+		resp := []byte{0, 128}
+		resp = binary.BigEndian.AppendUint16(resp, uint16(result.Load()))
+		resp = binary.BigEndian.AppendUint32(resp, 1234)
+		return append(resp, 203, 0, 113, 7)
+	})
+
+	d := &natpmpDetector{gateway: gateway}
+	got, err := d.DetectIP(context.Background(), "4")
+	if err != nil {
+		t.Fatalf("DetectIP() error = %v", err)
+	}
+	if got.String() != "203.0.113.7" {
+		t.Errorf("DetectIP() = %s, want 203.0.113.7", got)
+	}
+
+	if _, err := d.DetectIP(context.Background(), "6"); err == nil {
+		t.Errorf("DetectIP(6) succeeded, NAT-PMP is IPv4 only")
+	}
+
+	// Refused by the gateway.
+	result.Store(2)
+	if _, err := d.DetectIP(context.Background(), "4"); err == nil {
+		t.Errorf("DetectIP() with result code 2 succeeded")
+	}
+}
+
+// A detector that always gives the same answer.
+type fixedDetector struct {
+	ip  string
+	err error
+}
+
+func (d *fixedDetector) DetectIP(ctx context.Context, family string) (net.IP, error) {
+	return net.ParseIP(d.ip), d.err
+}
+
+func (d *fixedDetector) String() string {
+	return "fixed " + d.ip
+}
+
+func Test_detectIP(t *testing.T) {
+	silent := startUDPStandIn(t, func([]byte) []byte { return nil })
+	orig := ipDetectTimeout
+	t.Cleanup(func() { ipDetectTimeout = orig })
+	ipDetectTimeout = 500 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		detectors []ipDetector
+		family    string
+		want      string
+		wantErr   bool
+	}{
+		{"first works", []ipDetector{&fixedDetector{ip: "203.0.113.7"}, &fixedDetector{ip: "198.51.100.1"}}, "4", "203.0.113.7", false},
+		{"falls back", []ipDetector{&fixedDetector{err: fmt.Errorf("nope")}, &fixedDetector{ip: "198.51.100.1"}}, "4", "198.51.100.1", false},
+		{"falls back after timeout", []ipDetector{&stunDetector{server: silent}, &fixedDetector{ip: "198.51.100.1"}}, "4", "198.51.100.1", false},
+		{"wrong family", []ipDetector{&fixedDetector{ip: "203.0.113.7"}, &fixedDetector{ip: "2001:db8::1"}}, "6", "2001:db8::1", false},
+		{"none work", []ipDetector{&fixedDetector{err: fmt.Errorf("nope")}}, "4", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectIP(tt.detectors, tt.family)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("detectIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("detectIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"google.golang.org/api/dns/v1"
+)
+
+// One applied change, as a line of JSON in --journal-file.
+type journalEntry struct {
+	Time      string                   `json:"time"`
+	Project   string                   `json:"project"`
+	Zone      string                   `json:"zone"`
+	Id        string                   `json:"id"`
+	Source    string                   `json:"source"`
+	Reverts   string                   `json:"reverts,omitempty"`
+	Additions []*dns.ResourceRecordSet `json:"additions,omitempty"`
+	Deletions []*dns.ResourceRecordSet `json:"deletions,omitempty"`
+}
+
+func appendJournal(dnsSpec *CloudDNSSpec, out *dns.Change, reverts string) error {
+	if dnsSpec.journal_file == nil || *dnsSpec.journal_file == "" {
+		return nil
+	}
+	entry := journalEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Project:   *dnsSpec.project,
+		Zone:      *dnsSpec.zone,
+		Id:        out.Id,
+		Reverts:   reverts,
+		Additions: out.Additions,
+		Deletions: out.Deletions,
+	}
+	if dnsSpec.source != nil {
+		entry.Source = *dnsSpec.source
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*dnsSpec.journal_file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readJournal(journalFile string) ([]journalEntry, error) {
+	data, err := os.ReadFile(journalFile)
+	if err != nil {
+		return nil, err
+	}
+	ret := []journalEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		entry := journalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", journalFile, line, err)
+		}
+		ret = append(ret, entry)
+	}
+	return ret, scanner.Err()
+}
+
+func entriesToRollBack(dnsSpec *CloudDNSSpec, entries []journalEntry, count int) []journalEntry {
+	// The last count changes to this zone, newest first, skipping rollbacks
+	// and anything that's already been rolled back.
+	reverted := map[string]bool{}
+	for _, e := range entries {
+		if e.Reverts != "" {
+			reverted[e.Reverts] = true
+		}
+	}
+	ret := []journalEntry{}
+	for i := len(entries) - 1; i >= 0 && len(ret) < count; i-- {
+		e := entries[i]
+		if e.Project != *dnsSpec.project || e.Zone != *dnsSpec.zone {
+			continue
+		}
+		if e.Reverts != "" || reverted[e.Id] {
+			continue
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+func applyChangeToRrsets(rrs []*dns.ResourceRecordSet, change *dns.Change) ([]*dns.ResourceRecordSet, error) {
+	// What rrs would look like after change, or an error if change doesn't
+	// apply cleanly to it (the same checks Cloud DNS makes).
+	ret := []*dns.ResourceRecordSet{}
+	for _, rr := range rrs {
+		deleted := false
+		for _, d := range change.Deletions {
+			if sameRrsetKey(rr, d) {
+				if !rrsetsEqual(rr, d) {
+					return nil, fmt.Errorf("%s (%s) has changed since", d.Name, d.Type)
+				}
+				deleted = true
+			}
+		}
+		if !deleted {
+			ret = append(ret, rr)
+		}
+	}
+	for _, d := range change.Deletions {
+		found := false
+		for _, rr := range rrs {
+			if sameRrsetKey(rr, d) {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s (%s) no longer exists", d.Name, d.Type)
+		}
+	}
+	for _, a := range change.Additions {
+		for _, rr := range ret {
+			if sameRrsetKey(rr, a) {
+				return nil, fmt.Errorf("%s (%s) has been added since", a.Name, a.Type)
+			}
+		}
+		ret = append(ret, a)
+	}
+	return ret, nil
+}
+
+func planRollback(entries []journalEntry, cloud_rrs []*dns.ResourceRecordSet) ([]*dns.Change, error) {
+	// The inverse of each of entries (newest first), checking each applies
+	// cleanly to the zone as it will be by then.
+	ret := []*dns.Change{}
+	current := cloud_rrs
+	for _, e := range entries {
+		inverse := &dns.Change{
+			Additions: e.Deletions,
+			Deletions: e.Additions,
+		}
+		var err error
+		current, err = applyChangeToRrsets(current, inverse)
+		if err != nil {
+			return nil, fmt.Errorf("can't roll back change %s from %s: %s", e.Id, e.Time, err)
+		}
+		ret = append(ret, inverse)
+	}
+	return ret, nil
+}
+
+func rollbackChanges(dnsSpec *CloudDNSSpec, count int) error {
+	entries, err := readJournal(*dnsSpec.journal_file)
+	if err != nil {
+		return err
+	}
+	entries = entriesToRollBack(dnsSpec, entries, count)
+	if len(entries) == 0 {
+		return fmt.Errorf("no changes to zone %s in %s to roll back", *dnsSpec.zone, *dnsSpec.journal_file)
+	}
+	if len(entries) < count {
+		log.Printf("Only %d changes to zone %s in the journal", len(entries), *dnsSpec.zone)
+	}
+
+	cloud_rrs, err := getResourceRecordSetsForZone(dnsSpec)
+	if err != nil {
+		log.Print("Getting RRs for zone:", *dnsSpec.zone)
+		return err
+	}
+
+	changes, err := planRollback(entries, cloud_rrs)
+	if err != nil {
+		return err
+	}
+
+	for i, change := range changes {
+		log.Printf("Rolling back change %s (%s) from %s", entries[i].Id, entries[i].Source, entries[i].Time)
+		if err := applyCloudDnsChange(dnsSpec, change, entries[i].Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func Test_rollbackJournal(t *testing.T) {
+	test_project := "myproject"
+	test_zone := "myzone"
+	other_zone := "otherzone"
+	journal := filepath.Join(t.TempDir(), "journal.jsonl")
+	source := "putzonefile"
+	testDnsSpec := &CloudDNSSpec{
+		project:      &test_project,
+		zone:         &test_zone,
+		journal_file: &journal,
+		source:       &source,
+	}
+	otherDnsSpec := &CloudDNSSpec{
+		project:      &test_project,
+		zone:         &other_zone,
+		journal_file: &journal,
+		source:       &source,
+	}
+
+	www_old := &dns.ResourceRecordSet{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}}
+	www_new := &dns.ResourceRecordSet{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"2.2.2.2"}}
+	mail := &dns.ResourceRecordSet{Name: "mail.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"3.3.3.3"}}
+
+	// Change 1 modifies www, change 2 (in another zone) is noise, change 3 adds mail.
+	for _, c := range []struct {
+		spec   *CloudDNSSpec
+		change *dns.Change
+	}{
+		{testDnsSpec, &dns.Change{Id: "1", Additions: []*dns.ResourceRecordSet{www_new}, Deletions: []*dns.ResourceRecordSet{www_old}}},
+		{otherDnsSpec, &dns.Change{Id: "2", Additions: []*dns.ResourceRecordSet{mail}}},
+		{testDnsSpec, &dns.Change{Id: "3", Additions: []*dns.ResourceRecordSet{mail}}},
+	} {
+		if err := appendJournal(c.spec, c.change, ""); err != nil {
+			t.Fatalf("appendJournal() error = %v", err)
+		}
+	}
+
+	entries, err := readJournal(journal)
+	if err != nil {
+		t.Fatalf("readJournal() error = %v", err)
+	}
+	if len(entries) != 3 || entries[0].Source != "putzonefile" {
+		t.Fatalf("readJournal() = %v", entries)
+	}
+
+	todo := entriesToRollBack(testDnsSpec, entries, 5)
+	if len(todo) != 2 || todo[0].Id != "3" || todo[1].Id != "1" {
+		t.Fatalf("entriesToRollBack() = %v, want changes 3 and 1", todo)
+	}
+
+	// Rolling both back leaves just the old www.
+	changes, err := planRollback(todo, []*dns.ResourceRecordSet{www_new, mail})
+	if err != nil {
+		t.Fatalf("planRollback() error = %v", err)
+	}
+	after := []*dns.ResourceRecordSet{www_new, mail}
+	for _, c := range changes {
+		after, _ = applyChangeToRrsets(after, c)
+	}
+	if !rrsetListEquals(after, []*dns.ResourceRecordSet{www_old}) {
+		t.Errorf("zone after rollback = %v, want just %s", after, describeRrset(www_old))
+	}
+
+	// Someone's changed www since, so we can't roll back change 1.
+	www_other := &dns.ResourceRecordSet{Name: "www.mydomain.test.", Type: "A", Ttl: 60, Rrdatas: []string{"2.2.2.2"}}
+	if _, err := planRollback(todo, []*dns.ResourceRecordSet{www_other, mail}); err == nil {
+		t.Errorf("planRollback() rolled back over a changed rrset")
+	}
+
+	// Once change 3 is rolled back, the next rollback is change 1.
+	source = "rollback"
+	if err := appendJournal(testDnsSpec, &dns.Change{Id: "4", Deletions: []*dns.ResourceRecordSet{mail}}, "3"); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = readJournal(journal)
+	todo = entriesToRollBack(testDnsSpec, entries, 1)
+	if len(todo) != 1 || todo[0].Id != "1" {
+		t.Errorf("entriesToRollBack() after rollback = %v, want change 1", todo)
+	}
+}
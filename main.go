@@ -4,31 +4,18 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	google_oauth "golang.org/x/oauth2/google"
 	"google.golang.org/api/dns/v1"
 	"google.golang.org/api/option"
 )
 
-var (
-	dnsChangesProcessed = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "dns_changes_processed_total",
-		Help: "The total number of DNS changes processed",
-	})
-	dnsTotalRecordCount = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "dns_total_record_count",
-		Help: "The total number of DNS records",
-	})
-)
-
 type CloudDNSSpec struct {
 	svc         *dns.Service
 	project     *string
@@ -36,46 +23,116 @@ type CloudDNSSpec struct {
 	domain      *string
 	default_ttl *int
 	dry_run     *bool
+
+	// Safety limits on changes, see enforceChangeLimits()
+	max_deletions      *int
+	max_change_percent *int
+	allow_empty_zone   *bool
+
+	// Where to snapshot the zone before changing it. nil for nowhere.
+	snapshots          snapshotStore
+	snapshot_retention *int
+
+	// Where to record applied changes, and which verb made them.
+	journal_file *string
+	source       *string
+
+	// How long to wait for changes to be done, and whether to check the
+	// nameservers are serving them.
+	change_wait_secs   *int
+	verify_nameservers *bool
+
+	// Most additions or deletions to send in one change.
+	max_change_size *int
+
+	// How many times to rebuild and retry a change that conflicts or fails
+	// transiently.
+	max_retries *int
+
+	// Called with each change Cloud DNS accepts, if set.
+	on_change func(*dns.Change)
 }
 
-func getMyIP() (string, error) {
-	res, err := http.Get("http://whatismyip.akamai.com")
+func runValidateZonefile(dnsSpec *CloudDNSSpec, zoneFilename *string, format *string) error {
+	problems, err := validateZonefile(dnsSpec, zoneFilename, format)
 	if err != nil {
-		log.Fatal("HTTP Error getting our IP: ", err)
+		return err
 	}
-
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		log.Fatal("Error reading response body: ", err)
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", *zoneFilename, p)
 	}
-
-	ip := net.ParseIP(string(resBody))
-	if ip == nil {
-		log.Fatalf("Non-IP returned from request: %s", ip)
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) in %s", len(problems), *zoneFilename)
 	}
-
-	return string(resBody), nil
+	return nil
 }
 
 func main() {
 	var jsonKeyfile = flag.String("json-keyfile", "", "json credentials file for Cloud DNS")
 	var cloudProject = flag.String("cloud-project", "", "Google Cloud Project")
 	var cloudZone = flag.String("cloud-dns-zone", "", "Cloud DNS zone to operate on")
+	var cloudDomain = flag.String("cloud-dns-domain", "", "DNS name of the zone (e.g. myzone.mydomain.tld.). Looked up from --cloud-dns-zone if not set")
 	var defaultCloudTtl = flag.Int("cloud-dns-default-ttl", 300, "Default TTL for Cloud DNS records")
 	var dryRun = flag.Bool("dry-run", false, "Do not update Cloud DNS, print what would be done")
 	var pruneMissing = flag.Bool("prune-missing", false, "on putzonefile, prune cloud dns entries not in zone file")
+	var maxDeletions = flag.Int("max-deletions", -1, "refuse to apply changes deleting more than this many rrsets. -1 for no limit")
+	var maxChangePercent = flag.Int("max-change-percent", -1, "refuse to apply changes touching more than this percentage of the zone's rrsets. -1 for no limit")
+	var allowEmptyZone = flag.Bool("allow-empty-zone", false, "allow changes that would leave the zone with no records (other than SOA/NS)")
+
+	var snapshotLocation = flag.String("snapshot-location", "", "directory or gs://bucket/prefix to snapshot the zone to before every change")
+	var snapshotRetention = flag.Int("snapshot-retention", 0, "number of snapshots to keep per zone. 0 keeps them all")
+
+	var maxChangeSize = flag.Int("max-change-size", 1000, "split changes with more than this many additions or deletions into batches. 0 for no limit")
+	var maxRetries = flag.Int("max-retries", 5, "times to re-read the zone and retry a change that conflicts or fails with a retryable error")
+	var changeWaitSecs = flag.Int("change-wait-secs", 120, "seconds to wait for each change to be done in Cloud DNS. 0 to not wait")
+	var verifyNameservers = flag.Bool("verify-nameservers", false, "after each change, wait until the zone's nameservers serve it (within --change-wait-secs)")
+	var journalFile = flag.String("journal-file", "", "append every applied change to this file, for rollback")
 
 	// For [get|put]zonefile
 	var zoneFilename = flag.String("zonefilename", "", "Local zone file to operate on")
+	var zoneFormat = flag.String("format", "zonefile", "Format of --zonefilename: "+strings.Join(zoneFormats, ", "))
+	var zonefileGitCommit = flag.Bool("zonefile-git-commit", false, "on getzonefile, commit the written --zonefilename to the git repository it lives in")
+
+	// for plan
+	var planOutput = flag.String("plan-output", "text", "Output format for plan: text or json")
+	var planColor = flag.String("color", "auto", "Colour plan output: auto, always or never")
+	var planFile = flag.String("plan-file", "", "on plan or putzonefile --dry-run, save the change here. on apply, the plan to apply")
+
+	// for restore
+	var snapshotName = flag.String("snapshot", "", "on restore, the snapshot to restore, or 'latest'. Lists snapshots if not set")
+
+	// for rollback
+	var rollbackCount = flag.Int("rollback-count", 1, "on rollback, how many of the most recent changes to undo")
 
 	// for nomad_sync
 	var nomadServerURI = flag.String("nomad-server-uri", "http://localhost:4646", "URI for a nomad server to talk to.")
 	var nomadTokenFile = flag.String("nomad-token-file", "", "file to read ou rnomad token from")
 	var nomadSyncInterval = flag.Int("nomad-sync-interval-secs", 300, "seconds between nomad updates. set to -1 to sync once only.")
-	var httpPort = flag.Int("http-port", 8080, "Port to listen on for /metrics")
+	var readyMissedSyncs = flag.Int("ready-max-missed-syncs", 3, "/readyz fails if there's been no successful sync for this many intervals")
+	var pushgatewayURL = flag.String("pushgateway-url", "", "push metrics to this Prometheus Pushgateway when a one-shot verb finishes")
+	var apiTokenFile = flag.String("api-token-file", "", "file holding a bearer token for the /sync, /zone and /records HTTP API. API is off if not set")
+	var httpPort = flag.Int("http-port", 8080, "Port to listen on for /metrics, /healthz, /readyz and /status")
 
 	// for dynrecord
 	var cloudDnsDynRecordName = flag.String("cloud-dns-dyn-record-name", "", "Cloud DNS record to update with our IP")
+	var dynRecordsFile = flag.String("dyn-records-file", "", "YAML file listing dyn records to update, each with its own zone, type, TTL and IP source")
+	var dynRecordInterval = flag.Int("dyn-record-interval-secs", -1, "seconds between dynrecord updates. -1 (the default) updates once and exits.")
+	var dynRecordJitter = flag.Int("dyn-record-jitter-secs", 0, "Wait up to this many extra seconds, at random, between dynrecord updates")
+	var dynRecordHook = flag.String("dyn-record-hook", "", "Command to run (with sh -c) when dynrecord changes the record")
+	var dynRecordWebhook = flag.String("dyn-record-webhook", "", "URL to POST to when dynrecord changes the record")
+	var ipFamily = flag.String("ip-family", "4", "Which of our addresses to put in the dyn record: 4 (A), 6 (AAAA) or both")
+	ipDetect := &ipDetectSpec{
+		methods:        flag.String("ip-detect", "https", "Comma-separated ways to find our public IP, tried in order: https, stun, dns, interface, natpmp"),
+		urls:           flag.String("ip-detect-urls", "https://icanhazip.com,https://ifconfig.co/ip,https://api64.ipify.org", "Comma-separated HTTPS services that echo back our IP, for --ip-detect=https"),
+		quorum:         flag.Int("ip-detect-quorum", 2, "How many of --ip-detect-urls must agree on our IP"),
+		stun_server:    flag.String("ip-detect-stun-server", "stun.l.google.com:19302", "STUN server (host:port) for --ip-detect=stun"),
+		dns_server:     flag.String("ip-detect-dns-server", "", "Nameserver (host:port) answering myip.opendns.com for --ip-detect=dns. Default is OpenDNS over the family being detected"),
+		iface:          flag.String("ip-detect-interface", "", "Network interface to read our IP from for --ip-detect=interface"),
+		natpmp_gateway: flag.String("ip-detect-natpmp-gateway", "", "Gateway to ask over NAT-PMP for --ip-detect=natpmp (IPv4 only)"),
+	}
+
+	// for dyndns_server
+	var dyndnsUsersFile = flag.String("dyndns-users-file", "", "YAML file of dyndns users, their passwords and the hostnames they may update")
 
 	flag.Parse()
 
@@ -86,20 +143,102 @@ func main() {
 
 	verb := flag.Args()[0]
 
-	// Required in all cases
+	if verb == "putzonefile" || verb == "validatezonefile" || verb == "plan" {
+		if *zoneFilename == "" {
+			log.Fatalf("--zonefilename is required for %s", verb)
+		}
+	}
+
+	if *planOutput != "text" && *planOutput != "json" {
+		log.Fatal("--plan-output must be text or json")
+	}
+
+	if *planColor != "auto" && *planColor != "always" && *planColor != "never" {
+		log.Fatal("--color must be auto, always or never")
+	}
+
+	if !validZoneFormat(*zoneFormat) {
+		log.Fatalf("--format must be one of: %s", strings.Join(zoneFormats, ", "))
+	}
+
+	// One-shot verbs push their metrics on the way out, however they exit.
+	exit := func(code int) {
+		daemon := verb == "nomad_sync" || verb == "dyndns_server" || (verb == "dynrecord" && *dynRecordInterval > 0)
+		if *pushgatewayURL != "" && !daemon {
+			if err := pushMetrics(*pushgatewayURL, verb, *cloudZone); err != nil {
+				log.Print("Error pushing metrics: ", err)
+			}
+		}
+		if code != 0 {
+			os.Exit(code)
+		}
+	}
+	fatal := func(v ...interface{}) {
+		log.Print(v...)
+		exit(1)
+	}
+
+	// validatezonefile doesn't need to talk to Cloud DNS if we know the domain.
+	if verb == "validatezonefile" && *cloudDomain != "" {
+		domain := addDomainForZone(*cloudDomain, "")
+		err := runValidateZonefile(&CloudDNSSpec{
+			domain:      &domain,
+			default_ttl: defaultCloudTtl,
+		}, zoneFilename, zoneFormat)
+		if err != nil {
+			fatal("Error validating zonefile: ", err)
+		}
+		exit(0)
+		return
+	}
+
+	// Required in all other cases
 	if *cloudZone == "" {
 		log.Fatal("--cloud-dns-zone is required")
 	}
 
-	if verb == "putzonefile" {
-		if *zoneFilename == "" {
-			log.Fatal("--zonefilename is required for putzonefile")
+	if verb == "apply" {
+		if *planFile == "" {
+			log.Fatal("--plan-file is required for apply")
+		}
+	}
+
+	if verb == "restore" {
+		if *snapshotLocation == "" {
+			log.Fatal("--snapshot-location is required for restore")
+		}
+	}
+
+	if verb == "rollback" {
+		if *journalFile == "" {
+			log.Fatal("--journal-file is required for rollback")
+		}
+		if *rollbackCount < 1 {
+			log.Fatal("--rollback-count must be at least 1")
+		}
+	}
+
+	if verb == "dyndns_server" {
+		if *dyndnsUsersFile == "" {
+			log.Fatal("--dyndns-users-file is required for dyndns_server")
 		}
 	}
 
 	if verb == "dynrecord" {
-		if *cloudDnsDynRecordName == "" {
-			log.Fatal("--cloud-dns-dyn-record-name is required for dynrecord")
+		if *cloudDnsDynRecordName == "" && *dynRecordsFile == "" {
+			log.Fatal("--cloud-dns-dyn-record-name or --dyn-records-file is required for dynrecord")
+		}
+		if _, err := ipFamilies(*ipFamily); err != nil {
+			log.Fatal("--ip-family: ", err)
+		}
+		if _, err := newIPDetectors(ipDetect); err != nil {
+			log.Fatal("--ip-detect: ", err)
+		}
+		if *dynRecordInterval == 0 || *dynRecordInterval < -1 {
+			log.Fatal("--dyn-record-interval-secs must be positive, or -1 to update once")
+		}
+		if *dynRecordJitter < 0 {
+			log.Fatal("--dyn-record-jitter-secs can't be negative")
 		}
 	}
 
@@ -136,6 +275,33 @@ func main() {
 		zone:        cloudZone,
 		default_ttl: defaultCloudTtl,
 		dry_run:     dryRun,
+
+		max_deletions:      maxDeletions,
+		max_change_percent: maxChangePercent,
+		allow_empty_zone:   allowEmptyZone,
+
+		snapshot_retention: snapshotRetention,
+
+		journal_file: journalFile,
+		source:       &verb,
+
+		change_wait_secs:   changeWaitSecs,
+		verify_nameservers: verifyNameservers,
+
+		max_change_size: maxChangeSize,
+		max_retries:     maxRetries,
+	}
+
+	if *snapshotLocation != "" {
+		dns_spec.snapshots, err = newSnapshotStore(ctx, *snapshotLocation, option.WithCredentials(creds))
+		if err != nil {
+			log.Fatal("Snapshot store: ", err)
+		}
+	}
+
+	if *cloudDomain != "" {
+		domain := addDomainForZone(*cloudDomain, "")
+		dns_spec.domain = &domain
 	}
 
 	err = populateDnsSpec(dns_spec)
@@ -145,42 +311,96 @@ func main() {
 
 	switch verb {
 	case "getzonefile":
-		dumpZonefile(dns_spec)
+		if *zonefileGitCommit && *zoneFilename == "" {
+			fatal("--zonefile-git-commit needs --zonefilename")
+		}
+		err = dumpZonefile(dns_spec, zoneFilename, zoneFormat, zonefileGitCommit)
+		if err != nil {
+			fatal("Error exporting zonefile: ", err)
+		}
 	case "putzonefile":
-		uploadZonefile(dns_spec, zoneFilename, dryRun, pruneMissing)
-	case "dynrecord":
-		my_ip, err := getMyIP()
+		err = uploadZonefile(dns_spec, zoneFilename, zoneFormat, dryRun, pruneMissing, planFile)
 		if err != nil {
-			log.Fatalf("Error getting our IP: %s", err)
+			fatal("Error uploading zonefile: ", err)
 		}
-
-		log.Printf("Detected IP: %s", my_ip)
-
-		current_dns, err := net.LookupIP(*cloudDnsDynRecordName)
-
-		current_ip := ""
-
+	case "plan":
+		// Like terraform plan -detailed-exitcode: 0 for no changes, 2 for changes.
+		changed, err := planZonefile(dns_spec, zoneFilename, zoneFormat, pruneMissing, planOutput, planColor, planFile)
 		if err != nil {
-			log.Print("Error in DNS resolution: ", err)
-			log.Print("Continuing...")
+			fatal("Error planning zonefile: ", err)
+		}
+		if changed {
+			exit(2)
+		}
+	case "apply":
+		err = applyPlanFile(dns_spec, planFile)
+		if err != nil {
+			fatal("Error applying plan: ", err)
+		}
+	case "restore":
+		if *snapshotName == "" {
+			err = listSnapshots(dns_spec)
 		} else {
-			if len(current_dns) > 1 {
-				log.Fatalf("%s resolves to multiple IPs. Weird.", *cloudDnsDynRecordName)
+			err = restoreSnapshot(dns_spec, *snapshotName)
+		}
+		if err != nil {
+			fatal("Error restoring snapshot: ", err)
+		}
+	case "rollback":
+		err = rollbackChanges(dns_spec, *rollbackCount)
+		if err != nil {
+			fatal("Error rolling back: ", err)
+		}
+	case "validatezonefile":
+		err = runValidateZonefile(dns_spec, zoneFilename, zoneFormat)
+		if err != nil {
+			fatal("Error validating zonefile: ", err)
+		}
+	case "dynrecord":
+		families, _ := ipFamilies(*ipFamily)
+		detectors, _ := newIPDetectors(ipDetect)
+		hooks := &dynRecordHooks{command: *dynRecordHook, webhook: *dynRecordWebhook}
+		records := []*dynRecordSpec{}
+		if *cloudDnsDynRecordName != "" {
+			records = dynRecordsFromFlags(dns_spec, *cloudDnsDynRecordName, families)
+		}
+		if *dynRecordsFile != "" {
+			from_file, err := loadDynRecords(*dynRecordsFile, dns_spec)
+			if err != nil {
+				fatal("Reading dyn records: ", err)
 			}
-
-			current_ip = current_dns[0].To4().String()
-
-			if my_ip == current_ip {
-				log.Print("My IP matches DNS. Nothing to do.")
-				return
+			records = append(records, from_file...)
+		}
+		zones, err := resolveDynRecordZones(dns_spec, records)
+		if err != nil {
+			fatal("Error in dyn records: ", err)
+		}
+		if *dynRecordInterval < 0 {
+			if failed := runDynRecords(zones, detectors, records, hooks); failed > 0 {
+				fatal(fmt.Sprintf("%d of %d dyn record updates failed", failed, len(records)))
 			}
+			break
 		}
 
-		err = updateOneARecord(dns_spec, *cloudDnsDynRecordName, current_ip, my_ip)
-
+		http.Handle("/metrics", promhttp.Handler())
+		http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "ok")
+		})
+		go periodicallyUpdateDynRecords(zones, detectors, records, hooks, *dynRecordInterval, *dynRecordJitter)
+		log.Fatal(http.ListenAndServe(":"+fmt.Sprintf("%v", *httpPort), nil))
+	case "dyndns_server":
+		users, err := loadDyndnsUsers(*dyndnsUsersFile, *dns_spec.domain)
 		if err != nil {
-			log.Fatalf("Error Updating GCloud: %s", err)
+			log.Fatal("Reading dyndns users: ", err)
 		}
+
+		http.Handle("/metrics", promhttp.Handler())
+		http.Handle("/nic/update", newDyndnsServer(dns_spec, users))
+		http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "ok")
+		})
+
+		log.Fatal(http.ListenAndServe(":"+fmt.Sprintf("%v", *httpPort), nil))
 	case "nomad_sync":
 		nomadSpec := &NomadSpec{
 			uri: *nomadServerURI,
@@ -195,13 +415,41 @@ func main() {
 			nomadSpec.token = ""
 		}
 
+		state := &nomadSyncState{}
+		dns_spec.on_change = state.recordChange
+
+		// Ready if we've synced in the last few intervals.
+		readyMaxAge := time.Duration(0)
+		if *nomadSyncInterval > 0 {
+			readyMaxAge = time.Duration(*readyMissedSyncs**nomadSyncInterval) * time.Second
+		}
+
 		http.Handle("/metrics", promhttp.Handler())
+		registerStatusHandlers(http.DefaultServeMux, state, readyMaxAge, map[string]func() error{
+			"cloud dns": cloudDnsReachable(dns_spec),
+			"nomad":     nomadReachable(nomadSpec),
+		})
+
+		var trigger chan chan error
+		if *apiTokenFile != "" {
+			apiToken, err := os.ReadFile(*apiTokenFile)
+			if err != nil {
+				log.Fatal("Reading API Token: ", err)
+			}
+			if strings.TrimSpace(string(apiToken)) == "" {
+				log.Fatal("Empty API token in ", *apiTokenFile)
+			}
+			trigger = make(chan chan error)
+			registerApiHandlers(http.DefaultServeMux, dns_spec, strings.TrimSpace(string(apiToken)), trigger)
+		}
 
-		go periodicallySyncNomad(dns_spec, nomadSpec, *nomadSyncInterval, pruneMissing)
+		go periodicallySyncNomad(dns_spec, nomadSpec, *nomadSyncInterval, pruneMissing, state, trigger)
 
 		log.Fatal(http.ListenAndServe(":"+fmt.Sprintf("%v", *httpPort), nil))
 
 	default:
 		log.Fatal("Unknown verb: ", verb)
 	}
+
+	exit(0)
 }
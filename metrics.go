@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	dnsChangesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_changes_processed_total",
+		Help: "The total number of DNS changes processed",
+	}, []string{"zone"})
+	dnsTotalRecordCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_total_record_count",
+		Help: "The total number of DNS records (rdatas) in the zone, as of the last time we looked",
+	}, []string{"zone"})
+	dnsRecordsChanged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_rrsets_changed_total",
+		Help: "The total number of rrsets added, modified or deleted",
+	}, []string{"zone", "action"})
+	dnsDesiredRrsets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_desired_rrsets",
+		Help: "The number of rrsets (other than SOA and NS) we want in the zone, as of the last sync",
+	}, []string{"zone"})
+	dnsActualRrsets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_actual_rrsets",
+		Help: "The number of rrsets (other than SOA and NS) in the zone, as of the last sync",
+	}, []string{"zone"})
+	dnsDriftRrsets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_drift_rrsets",
+		Help: "The number of rrsets that differed from what we want, as of the last sync",
+	}, []string{"zone"})
+	dnsDriftDetected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_drift_detected_total",
+		Help: "The total number of syncs that found the zone differed from what we want",
+	}, []string{"zone"})
+	dnsSyncSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dns_sync_duration_seconds",
+		Help:    "Time taken to bring the zone in line, including retries",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 12),
+	}, []string{"zone", "verb", "result"})
+	dnsApiCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_api_calls_total",
+		Help: "The total number of Cloud DNS API calls",
+	}, []string{"zone", "method"})
+	dnsApiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_api_errors_total",
+		Help: "The total number of Cloud DNS API calls that failed, by HTTP status (0 if there was none)",
+	}, []string{"zone", "method", "code"})
+	dnsChangesBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_changes_blocked_total",
+		Help: "The total number of DNS changes refused by safety limits",
+	}, []string{"zone", "reason"})
+	dnsChangePropagationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dns_change_propagation_seconds",
+		Help:    "Time from submitting a DNS change until Cloud DNS reports it done, or until all nameservers serve it",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"zone", "stage"})
+	dnsChangeRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_change_retries_total",
+		Help: "The total number of times a DNS change was rebuilt and retried",
+	}, []string{"zone", "reason"})
+	dyndnsUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dyndns_updates_total",
+		Help: "The total number of dyndns2 hostname updates, by result (good, nochg, badauth, ...)",
+	}, []string{"result"})
+	dynRecordUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynrecord_updates_total",
+		Help: "The total number of dyn record checks, by record type and result (updated, unchanged, error)",
+	}, []string{"type", "result"})
+	dynRecordConsecutiveFailures = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dynrecord_consecutive_failures",
+		Help: "The number of dyn record updates in a row that have failed",
+	})
+	dynRecordLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dynrecord_last_success_timestamp_seconds",
+		Help: "When the dyn record was last successfully checked or updated, in seconds since the epoch",
+	})
+	nomadSyncConsecutiveFailures = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "nomad_sync_consecutive_failures",
+		Help: "The number of nomad syncs in a row that have failed",
+	})
+	nomadSyncLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "nomad_sync_last_success_timestamp_seconds",
+		Help: "When the last nomad sync succeeded, in seconds since the epoch",
+	})
+)
+
+func zoneLabel(dnsSpec *CloudDNSSpec) string {
+	if dnsSpec.zone == nil {
+		return ""
+	}
+	return *dnsSpec.zone
+}
+
+func countApiCall(dnsSpec *CloudDNSSpec, method string, err error) {
+	dnsApiCalls.WithLabelValues(zoneLabel(dnsSpec), method).Inc()
+	if err == nil {
+		return
+	}
+	code := 0
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		code = gerr.Code
+	}
+	dnsApiErrors.WithLabelValues(zoneLabel(dnsSpec), method, strconv.Itoa(code)).Inc()
+}
+
+func countZoneRecords(dnsSpec *CloudDNSSpec, rrs []*dns.ResourceRecordSet) {
+	total := 0
+	for _, rr := range rrs {
+		total += len(rr.Rrdatas)
+	}
+	dnsTotalRecordCount.WithLabelValues(zoneLabel(dnsSpec)).Set(float64(total))
+}
+
+func countChangedRrsets(dnsSpec *CloudDNSSpec, change *dns.Change) {
+	added, modified, deleted := countDiffs(diffDnsChange(change))
+	dnsRecordsChanged.WithLabelValues(zoneLabel(dnsSpec), "add").Add(float64(added))
+	dnsRecordsChanged.WithLabelValues(zoneLabel(dnsSpec), "modify").Add(float64(modified))
+	dnsRecordsChanged.WithLabelValues(zoneLabel(dnsSpec), "delete").Add(float64(deleted))
+}
+
+func recordDrift(dnsSpec *CloudDNSSpec, desired []*dns.ResourceRecordSet, cloud_rrs []*dns.ResourceRecordSet, change *dns.Change) {
+	// How the zone compares with what we want, each time we work it out.
+	zone := zoneLabel(dnsSpec)
+	dnsDesiredRrsets.WithLabelValues(zone).Set(float64(countManagedRrsets(desired)))
+	dnsActualRrsets.WithLabelValues(zone).Set(float64(countManagedRrsets(cloud_rrs)))
+	drift := len(diffDnsChange(change))
+	dnsDriftRrsets.WithLabelValues(zone).Set(float64(drift))
+	if drift > 0 {
+		dnsDriftDetected.WithLabelValues(zone).Inc()
+	}
+}
+
+func pushMetrics(url string, verb string, zone string) error {
+	// For one-shot verbs, which won't be around to be scraped. The grouping
+	// keys can't clash with our metrics' own "verb" and "zone" labels.
+	return push.New(url, "clouddns-sync").
+		Gatherer(prometheus.DefaultGatherer).
+		Grouping("command", verb).
+		Grouping("cloud_dns_zone", zone).
+		Push()
+}
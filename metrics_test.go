@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func Test_recordDrift(t *testing.T) {
+	test_zone := "driftzone"
+	test_domain := "mydomain.test."
+	testDnsSpec := &CloudDNSSpec{zone: &test_zone, domain: &test_domain}
+
+	cloud_rrs := []*dns.ResourceRecordSet{
+		{Name: "mydomain.test.", Type: "NS", Ttl: 21600, Rrdatas: []string{"ns1.example.com."}},
+		{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}},
+		{Name: "old.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"2.2.2.2"}},
+	}
+	desired := []*dns.ResourceRecordSet{
+		{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}},
+	}
+
+	recordDrift(testDnsSpec, desired, cloud_rrs, buildDnsChange(cloud_rrs, desired, true, *testDnsSpec.domain))
+	if got := testutil.ToFloat64(dnsDesiredRrsets.WithLabelValues(test_zone)); got != 1 {
+		t.Errorf("dns_desired_rrsets = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(dnsActualRrsets.WithLabelValues(test_zone)); got != 2 {
+		t.Errorf("dns_actual_rrsets = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(dnsDriftRrsets.WithLabelValues(test_zone)); got != 1 {
+		t.Errorf("dns_drift_rrsets = %v, want 1", got)
+	}
+
+	// No drift the next time round.
+	recordDrift(testDnsSpec, desired, desired, buildDnsChange(desired, desired, true, *testDnsSpec.domain))
+	if got := testutil.ToFloat64(dnsDriftRrsets.WithLabelValues(test_zone)); got != 0 {
+		t.Errorf("dns_drift_rrsets = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(dnsDriftDetected.WithLabelValues(test_zone)); got != 1 {
+		t.Errorf("dns_drift_detected_total = %v, want 1", got)
+	}
+}
+
+func Test_countApiCall(t *testing.T) {
+	test_zone := "apizone"
+	testDnsSpec := &CloudDNSSpec{zone: &test_zone}
+
+	countApiCall(testDnsSpec, "Changes.Create", nil)
+	countApiCall(testDnsSpec, "Changes.Create", &googleapi.Error{Code: 412})
+	countApiCall(testDnsSpec, "Changes.Create", errors.New("connection reset"))
+
+	if got := testutil.ToFloat64(dnsApiCalls.WithLabelValues(test_zone, "Changes.Create")); got != 3 {
+		t.Errorf("dns_api_calls_total = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(dnsApiErrors.WithLabelValues(test_zone, "Changes.Create", "412")); got != 1 {
+		t.Errorf("dns_api_errors_total{code=412} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(dnsApiErrors.WithLabelValues(test_zone, "Changes.Create", "0")); got != 1 {
+		t.Errorf("dns_api_errors_total{code=0} = %v, want 1", got)
+	}
+}
+
+func Test_pushMetrics(t *testing.T) {
+	var method, path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	if err := pushMetrics(srv.URL, "putzonefile", "myzone"); err != nil {
+		t.Fatalf("pushMetrics() error = %v", err)
+	}
+	// The grouping labels can come in any order.
+	parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+	grouping := map[string]string{}
+	for i := 0; i+1 < len(parts); i += 2 {
+		grouping[parts[i]] = parts[i+1]
+	}
+	if method != "PUT" || len(grouping) != 3 || grouping["job"] != "clouddns-sync" ||
+		grouping["command"] != "putzonefile" || grouping["cloud_dns_zone"] != "myzone" {
+		t.Errorf("pushMetrics() sent %s %s", method, path)
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	nomad "github.com/hashicorp/nomad/api"
+	"google.golang.org/api/dns/v1"
 )
 
 type TaskInfo struct {
@@ -19,86 +23,182 @@ type NomadSpec struct {
 	token string
 }
 
-func periodicallySyncNomad(dns_spec *CloudDNSSpec, nomadSpec *NomadSpec, interval int, pruneMissing *bool) {
-	syncNomad(dns_spec, nomadSpec, pruneMissing)
+// How nomad_sync is doing, for metrics and status.
+type nomadSyncState struct {
+	mu                  sync.Mutex
+	lastAttempt         time.Time
+	lastSuccess         time.Time
+	lastError           error
+	consecutiveFailures int
+	// The task locations from the last successful sync.
+	tasks []TaskInfo
+	// rrsets nomad wants, and managed rrsets in the zone before the last sync.
+	desiredRrsets int
+	actualRrsets  int
+	lastChange    *dns.Change
+}
 
-	if interval >= 0 {
-		for {
-			log.Printf("Waiting %d seconds.", interval)
-			time.Sleep(time.Duration(interval) * time.Second)
-			syncNomad(dns_spec, nomadSpec, pruneMissing)
-		}
+// Backoff between failed syncs. Doubles up to the sync interval.
+var nomadRetryInterval = 5 * time.Second
+
+func (s *nomadSyncState) recordSync(tasks []TaskInfo, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastAttempt = time.Now()
+	s.lastError = err
+	if err != nil {
+		s.consecutiveFailures++
+	} else {
+		s.consecutiveFailures = 0
+		s.lastSuccess = s.lastAttempt
+		s.tasks = tasks
+		nomadSyncLastSuccess.Set(float64(s.lastSuccess.Unix()))
 	}
+	nomadSyncConsecutiveFailures.Set(float64(s.consecutiveFailures))
 }
 
-func syncNomad(dnsSpec *CloudDNSSpec, nomadSpec *NomadSpec, pruneMissing *bool) {
-	//c := make(<-chan *dns.Change)
-	jobLocs := getNomadTaskLocations(nomadSpec)
+func (s *nomadSyncState) recordCounts(tasks []TaskInfo, actual int) {
+	// Each job is one rrset.
+	jobs := map[string]bool{}
+	for _, t := range tasks {
+		jobs[t.jobid] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.desiredRrsets = len(jobs)
+	s.actualRrsets = actual
+}
 
-	log.Printf("Found %d nomad jobs", len(jobLocs))
+func (s *nomadSyncState) recordChange(out *dns.Change) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastChange = out
+}
+
+func (s *nomadSyncState) failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.consecutiveFailures
+}
+
+func periodicallySyncNomad(dns_spec *CloudDNSSpec, nomadSpec *NomadSpec, interval int, pruneMissing *bool, state *nomadSyncState, trigger <-chan chan error) {
+	// Sync every interval seconds, and whenever someone sends on trigger
+	// (we send the result back on the channel they give us). With a
+	// negative interval, sync once and then only when triggered.
+	var done chan error
+	for {
+		tasks, err := syncNomad(dns_spec, nomadSpec, pruneMissing, state)
+		state.recordSync(tasks, err)
+		if err != nil {
+			log.Printf("Error syncing from nomad (%d in a row): %s", state.failures(), err)
+		}
+		if done != nil {
+			done <- err
+			done = nil
+		}
+
+		if interval < 0 && trigger == nil {
+			return
+		}
+
+		var timer <-chan time.Time
+		if interval >= 0 {
+			// Back off after failures, but never wait longer than usual.
+			wait := time.Duration(interval) * time.Second
+			if failures := state.failures(); failures > 0 && nomadRetryInterval < wait {
+				wait = backoffDelay(nomadRetryInterval, wait, failures-1)
+			}
+			log.Printf("Waiting %s.", wait.Round(time.Second))
+			timer = time.After(wait)
+		}
+
+		select {
+		case <-timer:
+		case done = <-trigger:
+			log.Print("Sync requested.")
+		}
+	}
+}
 
-	change, err := buildNomadDnsChange(dnsSpec, jobLocs, *pruneMissing)
+func syncNomad(dnsSpec *CloudDNSSpec, nomadSpec *NomadSpec, pruneMissing *bool, state *nomadSyncState) ([]TaskInfo, error) {
+	//c := make(<-chan *dns.Change)
+	jobLocs, err := getNomadTaskLocations(nomadSpec)
 	if err != nil {
-		log.Fatal("Building DNS change from nomad info:", err)
+		return nil, err
 	}
 
-	err = processCloudDnsChange(dnsSpec, change)
+	log.Printf("Found %d nomad jobs", len(jobLocs))
+
+	actual := 0
+	err = syncCloudDns(dnsSpec, func() (*dns.Change, error) {
+		change, cloud_rrs, err := buildNomadDnsChange(dnsSpec, jobLocs, *pruneMissing)
+		actual = countManagedRrsets(cloud_rrs)
+		return change, err
+	})
 
 	if err != nil {
-		log.Fatal("Updating Cloud DNS from nomad:", err)
+		return nil, fmt.Errorf("updating Cloud DNS from nomad: %s", err)
+	}
+	if state != nil {
+		state.recordCounts(jobLocs, actual)
 	}
-	dnsTotalRecordCount.Set(float64(len(jobLocs)))
+	return jobLocs, nil
 }
 
-func getNomadNodesList(nomadSpec *NomadSpec) NodeInfo {
-	conf := &nomad.Config{
-		Address: nomadSpec.uri,
-	}
+func nomadClient(nomadSpec *NomadSpec) (*nomad.Client, error) {
+	return nomad.NewClient(&nomad.Config{
+		Address:  nomadSpec.uri,
+		SecretID: strings.TrimSpace(nomadSpec.token),
+	})
+}
 
-	c, err := nomad.NewClient(conf)
+func getNomadNodesList(nomadSpec *NomadSpec) (NodeInfo, error) {
+	c, err := nomadClient(nomadSpec)
 	if err != nil {
-		log.Fatal("Talking to Nomad: ", err)
+		return nil, fmt.Errorf("talking to Nomad: %s", err)
 	}
 
 	nodes, _, err := c.Nodes().List(nil)
 	if err != nil {
-		log.Fatal("Getting Allocs from nomad: ", err)
+		return nil, fmt.Errorf("getting nodes from nomad: %s", err)
 	}
 
 	ret := NodeInfo{}
 	for _, n := range nodes {
 		if n.Address == "" {
-			log.Fatalf("Found nomad node %s with unknown IP", n.Name)
+			return nil, fmt.Errorf("found nomad node %s with unknown IP", n.Name)
 		}
 		ret[n.Name] = n.Address
 	}
 
-	return ret
+	return ret, nil
 }
 
-func getNomadAllocsList(nomadSpec *NomadSpec) []*nomad.AllocationListStub {
-	conf := &nomad.Config{
-		Address: nomadSpec.uri,
-	}
-
-	c, err := nomad.NewClient(conf)
+func getNomadAllocsList(nomadSpec *NomadSpec) ([]*nomad.AllocationListStub, error) {
+	c, err := nomadClient(nomadSpec)
 	if err != nil {
-		log.Fatal("Talking to Nomad: ", err)
+		return nil, fmt.Errorf("talking to Nomad: %s", err)
 	}
 
 	allocs, _, err := c.Allocations().List(nil)
 	if err != nil {
-		log.Fatal("Getting Allocs from nomad: ", err)
+		return nil, fmt.Errorf("getting allocs from nomad: %s", err)
 	}
 
-	return allocs
+	return allocs, nil
 }
 
-func getNomadTaskLocations(nomadSpec *NomadSpec) []TaskInfo {
+func getNomadTaskLocations(nomadSpec *NomadSpec) ([]TaskInfo, error) {
 	ret := []TaskInfo{}
 
-	allocs := getNomadAllocsList(nomadSpec)
-	nodes := getNomadNodesList(nomadSpec)
+	allocs, err := getNomadAllocsList(nomadSpec)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := getNomadNodesList(nomadSpec)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, a := range allocs {
 
@@ -117,5 +217,5 @@ func getNomadTaskLocations(nomadSpec *NomadSpec) []TaskInfo {
 
 	}
 
-	return ret
+	return ret, nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_syncNomadUnreachable(t *testing.T) {
+	// A broken nomad is an error, not the end of the world.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no leader", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	prune := true
+	_, err := syncNomad(&CloudDNSSpec{}, &NomadSpec{uri: srv.URL}, &prune, nil)
+	if err == nil {
+		t.Errorf("syncNomad() with a broken nomad succeeded")
+	}
+}
+
+func Test_nomadSyncState(t *testing.T) {
+	state := &nomadSyncState{}
+	good := []TaskInfo{{jobid: "myjob", ip: "1.2.3.4"}}
+
+	state.recordSync(good, nil)
+	success := state.lastSuccess
+	if state.failures() != 0 || success.IsZero() {
+		t.Fatalf("after success: %d failures, last success %s", state.failures(), success)
+	}
+
+	state.recordSync(nil, errors.New("nomad is down"))
+	state.recordSync(nil, errors.New("nomad is still down"))
+	if state.failures() != 2 {
+		t.Errorf("after two failures: %d failures, want 2", state.failures())
+	}
+	if state.lastSuccess != success || len(state.tasks) != 1 {
+		t.Errorf("failures lost the last good sync: %s, %v", state.lastSuccess, state.tasks)
+	}
+
+	state.recordSync(good, nil)
+	if state.failures() != 0 || state.lastError != nil {
+		t.Errorf("after recovering: %d failures, last error %v", state.failures(), state.lastError)
+	}
+}
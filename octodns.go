@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/dns/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// A record in an octoDNS zone config. Simple types have string values,
+// the rest have a map of fields per value.
+type octodnsRecord struct {
+	Type   string        `yaml:"type"`
+	Ttl    int64         `yaml:"ttl"`
+	Value  interface{}   `yaml:"value"`
+	Values []interface{} `yaml:"values"`
+}
+
+// The fields making up the rdata of octoDNS's structured types, in order.
+// Where octoDNS has accepted more than one name for a field over the
+// years, they're separated by '|'.
+var octodnsRdataFields = map[string][]string{
+	"MX":    {"preference|priority", "exchange|value"},
+	"SRV":   {"priority", "weight", "port", "target"},
+	"CAA":   {"flags", "tag", "value"},
+	"SSHFP": {"algorithm", "fingerprint_type", "fingerprint"},
+	"NAPTR": {"order", "preference", "flags", "service", "regexp", "replacement"},
+	"DS":    {"key_tag", "algorithm", "digest_type", "digest"},
+	"TLSA":  {"certificate_usage", "selector", "matching_type", "certificate_association_data"},
+}
+
+// Fields octoDNS lets you leave out, and what it takes them to be.
+var octodnsFieldDefaults = map[string]string{
+	"CAA/flags": "0",
+}
+
+// Fields that are character-strings and so need quoting in rdata.
+var octodnsQuotedFields = map[string]bool{
+	"CAA/value":     true,
+	"NAPTR/flags":   true,
+	"NAPTR/service": true,
+	"NAPTR/regexp":  true,
+}
+
+func octodnsRdata(rtype string, v interface{}) (string, error) {
+	switch rtype {
+	case "A", "AAAA", "CNAME", "DNAME", "NS", "PTR":
+		return fmt.Sprint(v), nil
+	case "TXT", "SPF":
+		// octoDNS wants semicolons escaped, Cloud DNS doesn't.
+		return quoteTxtString(strings.ReplaceAll(fmt.Sprint(v), `\;`, ";")), nil
+	}
+
+	fields, ok := octodnsRdataFields[rtype]
+	if !ok {
+		return "", fmt.Errorf("unsupported octoDNS record type %s", rtype)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("%s value should be a map, got %v", rtype, v)
+	}
+
+	ret := []string{}
+	for _, f := range fields {
+		found := false
+		for _, alias := range strings.Split(f, "|") {
+			fv, ok := m[alias]
+			if !ok {
+				continue
+			}
+			s := fmt.Sprint(fv)
+			if octodnsQuotedFields[rtype+"/"+alias] {
+				s = quoteTxtString(s)
+			}
+			ret = append(ret, s)
+			found = true
+			break
+		}
+		if d, ok := octodnsFieldDefaults[rtype+"/"+f]; !found && ok {
+			ret = append(ret, d)
+			found = true
+		}
+		if !found {
+			return "", fmt.Errorf("%s value missing '%s': %v", rtype, f, v)
+		}
+	}
+	return strings.Join(ret, " "), nil
+}
+
+func octodnsRecordToZoneRecord(name string, r octodnsRecord) (zoneRecord, error) {
+	ret := zoneRecord{
+		Name: name,
+		Type: strings.ToUpper(r.Type),
+		Ttl:  r.Ttl,
+	}
+	if name == "" {
+		ret.Name = "@"
+	}
+
+	values := r.Values
+	if r.Value != nil {
+		values = append(values, r.Value)
+	}
+	if len(values) == 0 {
+		return ret, fmt.Errorf("%s (%s): no value(s)", ret.Name, ret.Type)
+	}
+	for _, v := range values {
+		rd, err := octodnsRdata(ret.Type, v)
+		if err != nil {
+			return ret, fmt.Errorf("%s (%s): %s", ret.Name, ret.Type, err)
+		}
+		ret.Rrdatas = append(ret.Rrdatas, rd)
+	}
+	return ret, nil
+}
+
+func loadOctodnsRrsets(dnsSpec *CloudDNSSpec, data []byte) ([]*dns.ResourceRecordSet, []string, error) {
+	// An octoDNS zone config is a map of relative name to either a single
+	// record or a list of them.
+	config := map[string]yaml.Node{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, nil, err
+	}
+
+	// Keep things in a stable order, for the sake of log output.
+	names := []string{}
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	records := []zoneRecord{}
+	for _, name := range names {
+		node := config[name]
+		octo_records := []octodnsRecord{}
+		var err error
+		if node.Kind == yaml.SequenceNode {
+			err = node.Decode(&octo_records)
+		} else {
+			r := octodnsRecord{}
+			err = node.Decode(&r)
+			octo_records = append(octo_records, r)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", name, err)
+		}
+
+		for _, r := range octo_records {
+			zr, err := octodnsRecordToZoneRecord(name, r)
+			if err != nil {
+				return nil, nil, err
+			}
+			records = append(records, zr)
+		}
+	}
+
+	return zoneRecordsToRrsets(dnsSpec, records, "octodns")
+}
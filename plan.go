@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/dns/v1"
+)
+
+// Terminal colours for plan output.
+const (
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorReset  = "\033[0m"
+)
+
+// What a dns.Change does to a single rrset. Old is what's in Cloud DNS now
+// and New is what will be there afterwards; either is nil for a pure
+// addition or deletion.
+type rrsetDiff struct {
+	Name string
+	Type string
+	Old  *dns.ResourceRecordSet
+	New  *dns.ResourceRecordSet
+}
+
+func (d rrsetDiff) action() string {
+	switch {
+	case d.Old == nil:
+		return "add"
+	case d.New == nil:
+		return "delete"
+	}
+	return "modify"
+}
+
+func diffDnsChange(change *dns.Change) []rrsetDiff {
+	// Pair up deletions and additions of the same rrset, so a TTL change
+	// shows up as one modification rather than an unrelated delete and add.
+	ret := []rrsetDiff{}
+	if change == nil {
+		return ret
+	}
+	for _, a := range change.Additions {
+		ret = append(ret, rrsetDiff{Name: a.Name, Type: a.Type, New: a})
+	}
+	for _, d := range change.Deletions {
+		paired := false
+		for i := range ret {
+			if ret[i].Old == nil && sameRrsetKey(ret[i].New, d) {
+				ret[i].Old = d
+				paired = true
+				break
+			}
+		}
+		if !paired {
+			ret = append(ret, rrsetDiff{Name: d.Name, Type: d.Type, Old: d})
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Name != ret[j].Name {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].Type < ret[j].Type
+	})
+	return ret
+}
+
+func countDiffs(diffs []rrsetDiff) (added int, modified int, deleted int) {
+	for _, d := range diffs {
+		switch d.action() {
+		case "add":
+			added++
+		case "modify":
+			modified++
+		case "delete":
+			deleted++
+		}
+	}
+	return
+}
+
+func rrsetDiffLines(rr *dns.ResourceRecordSet) []string {
+	// One line per rdata, with the TTL, in canonical form so that only
+	// real differences show up.
+	ret := []string{}
+	if rr == nil {
+		return ret
+	}
+	n := normalizeRrset(rr)
+	for _, rd := range n.Rrdatas {
+		ret = append(ret, fmt.Sprintf("%d %s", n.Ttl, rd))
+	}
+	if n.RoutingPolicy != nil {
+		policy, _ := json.Marshal(routingPolicyValue(n.RoutingPolicy))
+		ret = append(ret, fmt.Sprintf("%d routingPolicy %s", n.Ttl, policy))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func renderRrsetDiff(d rrsetDiff, color bool) []string {
+	paint := func(c string, s string) string {
+		if !color {
+			return s
+		}
+		return c + s + colorReset
+	}
+
+	header := map[string]string{
+		"add":    paint(colorGreen, "+ "+d.Name+" ("+d.Type+")"),
+		"delete": paint(colorRed, "- "+d.Name+" ("+d.Type+")"),
+		"modify": paint(colorYellow, "~ "+d.Name+" ("+d.Type+")"),
+	}[d.action()]
+	ret := []string{header}
+
+	old_lines := rrsetDiffLines(d.Old)
+	new_lines := rrsetDiffLines(d.New)
+	contains := func(lines []string, l string) bool {
+		for _, x := range lines {
+			if x == l {
+				return true
+			}
+		}
+		return false
+	}
+	for _, l := range old_lines {
+		if contains(new_lines, l) {
+			ret = append(ret, "    "+l)
+		} else {
+			ret = append(ret, paint(colorRed, "  - "+l))
+		}
+	}
+	for _, l := range new_lines {
+		if !contains(old_lines, l) {
+			ret = append(ret, paint(colorGreen, "  + "+l))
+		}
+	}
+	return ret
+}
+
+func renderPlanText(diffs []rrsetDiff, color bool) string {
+	if len(diffs) == 0 {
+		return "No changes.\n"
+	}
+	ret := []string{}
+	for _, d := range diffs {
+		ret = append(ret, renderRrsetDiff(d, color)...)
+	}
+	added, modified, deleted := countDiffs(diffs)
+	ret = append(ret, "", fmt.Sprintf("Plan: %d to add, %d to modify, %d to delete.", added, modified, deleted))
+	return strings.Join(ret, "\n") + "\n"
+}
+
+// The JSON form of a plan.
+type planJSON struct {
+	Changes []planJSONChange `json:"changes"`
+	Summary struct {
+		Add    int `json:"add"`
+		Modify int `json:"modify"`
+		Delete int `json:"delete"`
+	} `json:"summary"`
+}
+
+type planJSONChange struct {
+	Action string      `json:"action"`
+	Name   string      `json:"name"`
+	Type   string      `json:"type"`
+	Old    *zoneRecord `json:"old,omitempty"`
+	New    *zoneRecord `json:"new,omitempty"`
+}
+
+func planZoneRecord(rr *dns.ResourceRecordSet) *zoneRecord {
+	if rr == nil {
+		return nil
+	}
+	n := normalizeRrset(rr)
+	return &zoneRecord{
+		Name:          n.Name,
+		Type:          n.Type,
+		Ttl:           n.Ttl,
+		Rrdatas:       n.Rrdatas,
+		RoutingPolicy: routingPolicyValue(n.RoutingPolicy),
+	}
+}
+
+func planJSONChanges(diffs []rrsetDiff) []planJSONChange {
+	ret := []planJSONChange{}
+	for _, d := range diffs {
+		ret = append(ret, planJSONChange{
+			Action: d.action(),
+			Name:   d.Name,
+			Type:   d.Type,
+			Old:    planZoneRecord(d.Old),
+			New:    planZoneRecord(d.New),
+		})
+	}
+	return ret
+}
+
+func renderPlanJSON(diffs []rrsetDiff) (string, error) {
+	plan := planJSON{Changes: planJSONChanges(diffs)}
+	plan.Summary.Add, plan.Summary.Modify, plan.Summary.Delete = countDiffs(diffs)
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+func useColor(mode string) bool {
+	// --color=auto means colour if stdout is a terminal and NO_COLOR isn't set.
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func planZonefile(dnsSpec *CloudDNSSpec, zoneFilename *string, format *string, pruneMissing *bool, output *string, color *string, planFile *string) (bool, error) {
+	// Print what putzonefile would do. Returns whether there are any changes.
+	change, cloud_rrs, err := buildZonefileChange(dnsSpec, zoneFilename, format, pruneMissing)
+	if err != nil {
+		return false, err
+	}
+
+	if *planFile != "" {
+		if err := writePlanFile(dnsSpec, *planFile, change, cloud_rrs); err != nil {
+			return false, err
+		}
+	}
+
+	diffs := diffDnsChange(change)
+	out := ""
+	if *output == "json" {
+		out, err = renderPlanJSON(diffs)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		out = renderPlanText(diffs, useColor(*color))
+	}
+	fmt.Print(out)
+
+	return len(diffs) > 0, nil
+}
+
+// A change saved for applying later, along with what it was computed against.
+type savedPlan struct {
+	Project     string      `json:"project"`
+	Zone        string      `json:"zone"`
+	Fingerprint string      `json:"fingerprint"`
+	Change      *dns.Change `json:"change"`
+}
+
+func zoneFingerprint(rrs []*dns.ResourceRecordSet) string {
+	// A hash of the zone contents that doesn't care about ordering or
+	// how the rdata happens to be written.
+	lines := []string{}
+	for _, rr := range rrs {
+		n := normalizeRrset(rr)
+		for _, l := range rrsetDiffLines(n) {
+			lines = append(lines, fmt.Sprintf("%s %s %s", n.Name, n.Type, l))
+		}
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func writePlanFile(dnsSpec *CloudDNSSpec, planFile string, change *dns.Change, cloud_rrs []*dns.ResourceRecordSet) error {
+	plan := savedPlan{
+		Project:     *dnsSpec.project,
+		Zone:        *dnsSpec.zone,
+		Fingerprint: zoneFingerprint(cloud_rrs),
+		Change:      change,
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(planFile, data); err != nil {
+		return err
+	}
+	log.Printf("Wrote plan to %s", planFile)
+	return nil
+}
+
+func readPlanFile(planFile string) (*savedPlan, error) {
+	data, err := os.ReadFile(planFile)
+	if err != nil {
+		return nil, err
+	}
+	plan := &savedPlan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("%s: %s", planFile, err)
+	}
+	if plan.Change == nil {
+		plan.Change = &dns.Change{}
+	}
+	return plan, nil
+}
+
+func applyPlanFile(dnsSpec *CloudDNSSpec, planFile *string) error {
+	// Apply exactly the change in planFile, but only if the zone still looks
+	// like it did when the plan was made.
+	plan, err := readPlanFile(*planFile)
+	if err != nil {
+		return err
+	}
+
+	if plan.Project != *dnsSpec.project || plan.Zone != *dnsSpec.zone {
+		return fmt.Errorf("plan is for zone %s in project %s, not %s in %s",
+			plan.Zone, plan.Project, *dnsSpec.zone, *dnsSpec.project)
+	}
+
+	cloud_rrs, err := getResourceRecordSetsForZone(dnsSpec)
+	if err != nil {
+		log.Print("Getting RRs for zone:", *dnsSpec.zone)
+		return err
+	}
+
+	if fp := zoneFingerprint(cloud_rrs); fp != plan.Fingerprint {
+		return fmt.Errorf("zone %s has changed since the plan was made (%s, plan has %s), re-run plan",
+			*dnsSpec.zone, fp, plan.Fingerprint)
+	}
+
+	return processCloudDnsChange(dnsSpec, plan.Change)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func Test_renderPlanText(t *testing.T) {
+	oldA := &dns.ResourceRecordSet{Name: "www.doot.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4", "5.6.7.8"}}
+	newA := &dns.ResourceRecordSet{Name: "www.doot.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4", "9.9.9.9"}}
+	oldTtl := &dns.ResourceRecordSet{Name: "ftp.doot.", Type: "CNAME", Ttl: 300, Rrdatas: []string{"www.doot."}}
+	newTtl := &dns.ResourceRecordSet{Name: "ftp.doot.", Type: "CNAME", Ttl: 60, Rrdatas: []string{"www.doot."}}
+	added := &dns.ResourceRecordSet{Name: "new.doot.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"hello"`}}
+	deleted := &dns.ResourceRecordSet{Name: "old.doot.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}}
+
+	tests := []struct {
+		name   string
+		change *dns.Change
+		want   string
+	}{
+		{
+			name:   "NoChanges",
+			change: &dns.Change{},
+			want:   "No changes.\n",
+		},
+		{
+			name: "Mixed",
+			change: &dns.Change{
+				Additions: []*dns.ResourceRecordSet{newA, newTtl, added},
+				Deletions: []*dns.ResourceRecordSet{deleted, oldTtl, oldA},
+			},
+			want: `~ ftp.doot. (CNAME)
+  - 300 www.doot.
+  + 60 www.doot.
++ new.doot. (TXT)
+  + 300 "hello"
+- old.doot. (A)
+  - 300 1.1.1.1
+~ www.doot. (A)
+    300 1.2.3.4
+  - 300 5.6.7.8
+  + 300 9.9.9.9
+
+Plan: 1 to add, 2 to modify, 1 to delete.
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderPlanText(diffDnsChange(tt.change), false); got != tt.want {
+				t.Errorf("renderPlanText() = '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_renderPlanJSON(t *testing.T) {
+	change := &dns.Change{
+		Additions: []*dns.ResourceRecordSet{
+			{Name: "www.doot.", Type: "A", Ttl: 60, Rrdatas: []string{"1.2.3.4"}},
+		},
+		Deletions: []*dns.ResourceRecordSet{
+			{Name: "www.doot.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4"}},
+		},
+	}
+
+	out, err := renderPlanJSON(diffDnsChange(change))
+	if err != nil {
+		t.Fatalf("renderPlanJSON() error = %v", err)
+	}
+	got := planJSON{}
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("renderPlanJSON() gave bad JSON: %v", err)
+	}
+	if len(got.Changes) != 1 || got.Changes[0].Action != "modify" {
+		t.Errorf("renderPlanJSON() changes = %+v, want one modify", got.Changes)
+	}
+	if got.Changes[0].Old.Ttl != 300 || got.Changes[0].New.Ttl != 60 {
+		t.Errorf("renderPlanJSON() old/new = %+v / %+v", got.Changes[0].Old, got.Changes[0].New)
+	}
+	if got.Summary.Add != 0 || got.Summary.Modify != 1 || got.Summary.Delete != 0 {
+		t.Errorf("renderPlanJSON() summary = %+v", got.Summary)
+	}
+}
+
+func Test_zoneFingerprint(t *testing.T) {
+	a := &dns.ResourceRecordSet{Name: "www.doot.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4", "5.6.7.8"}}
+	b := &dns.ResourceRecordSet{Name: "WWW.doot", Type: "AAAA", Ttl: 300, Rrdatas: []string{"0:0::1"}}
+
+	// Order and spelling of the same data doesn't matter.
+	a2 := &dns.ResourceRecordSet{Name: "www.doot.", Type: "A", Ttl: 300, Rrdatas: []string{"5.6.7.8", "1.2.3.4"}}
+	b2 := &dns.ResourceRecordSet{Name: "www.doot.", Type: "AAAA", Ttl: 300, Rrdatas: []string{"::1"}}
+	if zoneFingerprint([]*dns.ResourceRecordSet{a, b}) != zoneFingerprint([]*dns.ResourceRecordSet{b2, a2}) {
+		t.Errorf("zoneFingerprint() differs for equivalent zones")
+	}
+
+	// Real changes do.
+	a3 := &dns.ResourceRecordSet{Name: "www.doot.", Type: "A", Ttl: 60, Rrdatas: []string{"1.2.3.4", "5.6.7.8"}}
+	if zoneFingerprint([]*dns.ResourceRecordSet{a, b}) == zoneFingerprint([]*dns.ResourceRecordSet{a3, b}) {
+		t.Errorf("zoneFingerprint() is the same after a TTL change")
+	}
+	if zoneFingerprint([]*dns.ResourceRecordSet{a, b}) == zoneFingerprint([]*dns.ResourceRecordSet{a}) {
+		t.Errorf("zoneFingerprint() is the same after removing an rrset")
+	}
+}
+
+func Test_planFileRoundTrip(t *testing.T) {
+	project := "myproject"
+	zone := "myzone"
+	testDnsSpec := &CloudDNSSpec{
+		project: &project,
+		zone:    &zone,
+	}
+	cloud_rrs := []*dns.ResourceRecordSet{
+		{Name: "www.doot.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4"}},
+	}
+	change := &dns.Change{
+		Additions: []*dns.ResourceRecordSet{{Name: "www.doot.", Type: "A", Ttl: 300, Rrdatas: []string{"5.6.7.8"}}},
+		Deletions: cloud_rrs,
+	}
+
+	planFile := t.TempDir() + "/myzone.plan"
+	if err := writePlanFile(testDnsSpec, planFile, change, cloud_rrs); err != nil {
+		t.Fatalf("writePlanFile() error = %v", err)
+	}
+	got, err := readPlanFile(planFile)
+	if err != nil {
+		t.Fatalf("readPlanFile() error = %v", err)
+	}
+	if got.Project != project || got.Zone != zone {
+		t.Errorf("readPlanFile() project/zone = %s/%s", got.Project, got.Zone)
+	}
+	if got.Fingerprint != zoneFingerprint(cloud_rrs) {
+		t.Errorf("readPlanFile() fingerprint = %s, want %s", got.Fingerprint, zoneFingerprint(cloud_rrs))
+	}
+	if !rrsetListEquals(got.Change.Additions, change.Additions) || !rrsetListEquals(got.Change.Deletions, change.Deletions) {
+		t.Errorf("readPlanFile() change = %+v, want %+v", got.Change, change)
+	}
+}
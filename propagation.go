@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"google.golang.org/api/dns/v1"
+)
+
+// How often to check on a pending change. Doubles up to changePollMax.
+var (
+	changePollInterval = time.Second
+	changePollMax      = 10 * time.Second
+)
+
+// Types we know how to check on the nameservers.
+var verifiableTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+func answerRdata(r dnsmessage.Resource) (string, bool) {
+	switch b := r.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String(), true
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String(), true
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String(), true
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX.String()), true
+	case *dnsmessage.NSResource:
+		return b.NS.String(), true
+	case *dnsmessage.PTRResource:
+		return b.PTR.String(), true
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target.String()), true
+	case *dnsmessage.TXTResource:
+		quoted := []string{}
+		for _, s := range b.TXT {
+			quoted = append(quoted, quoteTxtString(s))
+		}
+		return strings.Join(quoted, " "), true
+	}
+	return "", false
+}
+
+func exchangeDNS(ctx context.Context, network string, server string, query []byte) ([]byte, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	// TCP messages have a two byte length prefix.
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(conn, buf)
+	return buf, err
+}
+
+func queryNameserver(ctx context.Context, server string, name string, rtype string) (*dns.ResourceRecordSet, error) {
+	// Ask server directly what it serves for name/rtype. server is host:port.
+	// Returns an rrset with no rrdatas if there's nothing there.
+	qtype, ok := verifiableTypes[rtype]
+	if !ok {
+		return nil, fmt.Errorf("can't query for %s records", rtype)
+	}
+	qname, err := dnsmessage.NewName(normalizeName(name))
+	if err != nil {
+		return nil, err
+	}
+
+	id := uint16(time.Now().UnixNano())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	var h dnsmessage.Header
+	for _, network := range []string{"udp", "tcp"} {
+		resp, err := exchangeDNS(ctx, network, server, query)
+		if err != nil {
+			return nil, err
+		}
+		h, err = p.Start(resp)
+		if err != nil {
+			return nil, err
+		}
+		if h.ID != id {
+			return nil, fmt.Errorf("%s: mismatched reply ID", server)
+		}
+		if !h.Truncated {
+			break
+		}
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, fmt.Errorf("%s: %s", server, h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	ret := &dns.ResourceRecordSet{Name: normalizeName(name), Type: rtype}
+	for {
+		r, err := p.Answer()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Skip anything else along the way, like the CNAME chain.
+		if r.Header.Type != qtype || !strings.EqualFold(r.Header.Name.String(), ret.Name) {
+			continue
+		}
+		rd, ok := answerRdata(r)
+		if !ok {
+			continue
+		}
+		ret.Ttl = int64(r.Header.TTL)
+		ret.Rrdatas = append(ret.Rrdatas, rd)
+	}
+	return ret, nil
+}
+
+func servedAsExpected(served *dns.ResourceRecordSet, want *dns.ResourceRecordSet) bool {
+	// want nil means it should be gone.
+	if want == nil {
+		return len(served.Rrdatas) == 0
+	}
+	return rrsetsEqual(served, want)
+}
+
+func expectedServedRrsets(change *dns.Change) map[*dns.ResourceRecordSet]*dns.ResourceRecordSet {
+	// What we expect to see on the nameservers after change, keyed by an
+	// rrset with the name and type to ask for. nil means nothing at all.
+	// We can only check types we can decode, and not routing policies,
+	// since what's served for those depends on who's asking.
+	ret := map[*dns.ResourceRecordSet]*dns.ResourceRecordSet{}
+	for _, d := range diffDnsChange(change) {
+		if _, ok := verifiableTypes[strings.ToUpper(d.Type)]; !ok {
+			continue
+		}
+		if d.New != nil && d.New.RoutingPolicy != nil {
+			continue
+		}
+		ret[&dns.ResourceRecordSet{Name: d.Name, Type: strings.ToUpper(d.Type)}] = d.New
+	}
+	return ret
+}
+
+func verifyNameservers(ctx context.Context, nameservers []string, change *dns.Change) error {
+	// Poll each of nameservers until they all serve what change says they
+	// should, or ctx runs out.
+	pending := expectedServedRrsets(change)
+	interval := changePollInterval
+	for {
+		for q, want := range pending {
+			ok := true
+			for _, ns := range nameservers {
+				served, err := queryNameserver(ctx, ns, q.Name, q.Type)
+				if err != nil {
+					log.Printf("Querying %s for %s (%s): %s", ns, q.Name, q.Type, err)
+					ok = false
+					break
+				}
+				if !servedAsExpected(served, want) {
+					ok = false
+					break
+				}
+			}
+			if ok {
+				delete(pending, q)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			missing := []string{}
+			for q := range pending {
+				missing = append(missing, fmt.Sprintf("%s (%s)", q.Name, q.Type))
+			}
+			return fmt.Errorf("nameservers not serving %s yet", strings.Join(missing, ", "))
+		case <-time.After(interval):
+		}
+		interval = min(interval*2, changePollMax)
+	}
+}
+
+func zoneNameservers(dnsSpec *CloudDNSSpec) ([]string, error) {
+	// The zone's authoritative nameservers, as host:port.
+	zone, err := dnsSpec.svc.ManagedZones.Get(*dnsSpec.project, *dnsSpec.zone).Do()
+	countApiCall(dnsSpec, "ManagedZones.Get", err)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, ns := range zone.NameServers {
+		ret = append(ret, net.JoinHostPort(strings.TrimSuffix(ns, "."), "53"))
+	}
+	return ret, nil
+}
+
+func waitForChangeDone(ctx context.Context, dnsSpec *CloudDNSSpec, out *dns.Change) error {
+	// Poll Changes.Get until Cloud DNS says out is done, or ctx runs out.
+	interval := changePollInterval
+	for out.Status != "done" {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("change %s still %s", out.Id, out.Status)
+		case <-time.After(interval):
+		}
+		interval = min(interval*2, changePollMax)
+
+		var err error
+		out, err = dnsSpec.svc.Changes.Get(*dnsSpec.project, *dnsSpec.zone, out.Id).Context(ctx).Do()
+		countApiCall(dnsSpec, "Changes.Get", err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func waitForChange(dnsSpec *CloudDNSSpec, out *dns.Change, start time.Time) error {
+	// Wait for out to be done, and served by the zone's nameservers if
+	// we've been asked to check, recording how long each took.
+	if dnsSpec.change_wait_secs == nil || *dnsSpec.change_wait_secs <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*dnsSpec.change_wait_secs)*time.Second)
+	defer cancel()
+
+	if err := waitForChangeDone(ctx, dnsSpec, out); err != nil {
+		return fmt.Errorf("waiting for change %s: %w", out.Id, err)
+	}
+	elapsed := time.Since(start)
+	dnsChangePropagationSeconds.WithLabelValues(*dnsSpec.zone, "done").Observe(elapsed.Seconds())
+	log.Printf("Change %s done after %s", out.Id, elapsed.Round(time.Millisecond))
+
+	if dnsSpec.verify_nameservers == nil || !*dnsSpec.verify_nameservers {
+		return nil
+	}
+	nameservers, err := zoneNameservers(dnsSpec)
+	if err != nil {
+		return fmt.Errorf("getting nameservers for zone %s: %w", *dnsSpec.zone, err)
+	}
+	if err := verifyNameservers(ctx, nameservers, out); err != nil {
+		return fmt.Errorf("verifying change %s: %w", out.Id, err)
+	}
+	elapsed = time.Since(start)
+	dnsChangePropagationSeconds.WithLabelValues(*dnsSpec.zone, "served").Observe(elapsed.Seconds())
+	log.Printf("Change %s served by all %d nameservers after %s", out.Id, len(nameservers), elapsed.Round(time.Millisecond))
+	return nil
+}
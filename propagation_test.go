@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"google.golang.org/api/dns/v1"
+)
+
+// A tiny authoritative nameserver on localhost, answering from records.
+func startTestNameserver(t *testing.T, records func() []dnsmessage.Resource) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			for _, r := range records() {
+				if r.Header.Type == q.Type && strings.EqualFold(r.Header.Name.String(), q.Name.String()) {
+					r.Header.Class = dnsmessage.ClassINET
+					switch body := r.Body.(type) {
+					case *dnsmessage.AResource:
+						b.AResource(r.Header, *body)
+					case *dnsmessage.AAAAResource:
+						b.AAAAResource(r.Header, *body)
+					case *dnsmessage.MXResource:
+						b.MXResource(r.Header, *body)
+					case *dnsmessage.TXTResource:
+						b.TXTResource(r.Header, *body)
+					}
+				}
+			}
+			resp, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func Test_verifyNameservers(t *testing.T) {
+	www := dnsmessage.MustNewName("www.mydomain.test.")
+	apex := dnsmessage.MustNewName("mydomain.test.")
+	var updated atomic.Bool
+	ns := startTestNameserver(t, func() []dnsmessage.Resource {
+		ret := []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{Name: apex, Type: dnsmessage.TypeMX, TTL: 3600}, Body: &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mail.mydomain.test.")}},
+			{Header: dnsmessage.ResourceHeader{Name: apex, Type: dnsmessage.TypeTXT, TTL: 300}, Body: &dnsmessage.TXTResource{TXT: []string{`v=spf1 "quoted" -all`}}},
+		}
+		ip := [4]byte{1, 1, 1, 1}
+		if updated.Load() {
+			ip = [4]byte{2, 2, 2, 2}
+		}
+		return append(ret, dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: www, Type: dnsmessage.TypeA, TTL: 300}, Body: &dnsmessage.AResource{A: ip}})
+	})
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name  string
+		rtype string
+		want  *dns.ResourceRecordSet
+	}{
+		{"www.mydomain.test.", "A", &dns.ResourceRecordSet{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}}},
+		{"MyDomain.test", "MX", &dns.ResourceRecordSet{Name: "mydomain.test.", Type: "MX", Ttl: 3600, Rrdatas: []string{"10 mail.mydomain.test."}}},
+		{"mydomain.test.", "TXT", &dns.ResourceRecordSet{Name: "mydomain.test.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"v=spf1 \"quoted\" -all"`}}},
+		{"nothere.mydomain.test.", "A", nil},
+	} {
+		got, err := queryNameserver(ctx, ns, tt.name, tt.rtype)
+		if err != nil {
+			t.Fatalf("queryNameserver(%s, %s) error = %v", tt.name, tt.rtype, err)
+		}
+		if !servedAsExpected(got, tt.want) {
+			t.Errorf("queryNameserver(%s, %s) = %s, want %v", tt.name, tt.rtype, describeRrset(got), tt.want)
+		}
+	}
+
+	orig := changePollInterval
+	changePollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { changePollInterval = orig })
+	change := &dns.Change{
+		Additions: []*dns.ResourceRecordSet{{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"2.2.2.2"}}},
+		Deletions: []*dns.ResourceRecordSet{{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}}},
+	}
+
+	// Times out while the nameserver is still serving the old address...
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := verifyNameservers(short, []string{ns}, change); err == nil {
+		t.Errorf("verifyNameservers() succeeded before the change was served")
+	}
+
+	// ...and succeeds once it's updated.
+	time.AfterFunc(30*time.Millisecond, func() { updated.Store(true) })
+	long, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := verifyNameservers(long, []string{ns}, change); err != nil {
+		t.Errorf("verifyNameservers() error = %v", err)
+	}
+}
+
+func Test_waitForChangeDone(t *testing.T) {
+	var polls atomic.Int32
+	testDnsSpec := newTestCloudDnsSpec(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/projects/myproject/managedZones/myzone/changes/42") {
+			http.NotFound(w, r)
+			return
+		}
+		status := "pending"
+		if polls.Add(1) >= 3 {
+			status = "done"
+		}
+		json.NewEncoder(w).Encode(&dns.Change{Id: "42", Status: status})
+	}))
+
+	orig := changePollInterval
+	changePollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { changePollInterval = orig })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := waitForChangeDone(ctx, testDnsSpec, &dns.Change{Id: "42", Status: "pending"}); err != nil {
+		t.Errorf("waitForChangeDone() error = %v", err)
+	}
+	if polls.Load() != 3 {
+		t.Errorf("waitForChangeDone() polled %d times, want 3", polls.Load())
+	}
+}
+
+func Test_applyCloudDnsChangeUnconfirmed(t *testing.T) {
+	// The fake has no managed zone to find nameservers from, so verifying
+	// each batch fails after Cloud DNS has made it.
+	testDnsSpec, fake := newFakeCloudDnsSpec(t, nil)
+	wait_secs := 1
+	verify := true
+	batch_size := 1
+	testDnsSpec.change_wait_secs = &wait_secs
+	testDnsSpec.verify_nameservers = &verify
+	testDnsSpec.max_change_size = &batch_size
+
+	change := &dns.Change{Additions: []*dns.ResourceRecordSet{
+		{Name: "a.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}},
+		{Name: "b.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"2.2.2.2"}},
+	}}
+	if err := applyCloudDnsChange(testDnsSpec, change, ""); err != nil {
+		t.Errorf("applyCloudDnsChange() error = %v", err)
+	}
+	if len(fake.changes) != 2 {
+		t.Errorf("applyCloudDnsChange() made %d changes, want 2", len(fake.changes))
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/dns/v1"
+)
+
+// The longest a single TXT character-string can be on the wire.
+const maxTxtStringLen = 255
+
+// Which whitespace-separated fields of an rdata hold domain names, per
+// record type. Types not listed here have no embedded names we touch.
+var rdataNameFields = map[string][]int{
+	"CNAME": {0},
+	"DNAME": {0},
+	"NS":    {0},
+	"PTR":   {0},
+	"MX":    {1},
+	"SRV":   {3},
+	// Only from the JSON and YAML formats, go-zonefile can't parse these.
+	"SVCB":  {1},
+	"HTTPS": {1},
+	"SOA":   {0, 1},
+}
+
+func qualifyName(name string, origin string) string {
+	// '@' is the origin itself, anything else not ending in '.' is relative to it.
+	if name == "@" {
+		return origin
+	}
+	return addDomainForZone(name, origin)
+}
+
+func qualifyRdata(rtype string, rdata string, origin string) string {
+	// Fully qualify any domain names embedded in a single rdata of type rtype.
+	name_fields, ok := rdataNameFields[rtype]
+	if !ok {
+		return rdata
+	}
+
+	fields := strings.Fields(rdata)
+	for _, i := range name_fields {
+		if i < len(fields) {
+			fields[i] = qualifyName(fields[i], origin)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func quoteTxtString(s string) string {
+	// Quote a character-string, escaping quotes, backslashes and anything
+	// unprintable.
+	ret := strings.Builder{}
+	ret.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			ret.WriteByte('\\')
+			ret.WriteByte(c)
+		case c < ' ' || c > '~':
+			ret.WriteString(fmt.Sprintf("\\%03d", c))
+		default:
+			ret.WriteByte(c)
+		}
+	}
+	ret.WriteByte('"')
+	return ret.String()
+}
+
+func rdataFromZoneValues(rtype string, values [][]byte) string {
+	// go-zonefile hands us the rdata as separate (unquoted) tokens.
+	// Glue them back into the single string Cloud DNS wants, quoting each
+	// character-string for TXT-like records.
+	ret := []string{}
+	for _, v := range values {
+		if rtype == "TXT" || rtype == "SPF" {
+			ret = append(ret, quoteTxtString(decodeDecimalEscapes(string(v))))
+		} else {
+			ret = append(ret, string(v))
+		}
+	}
+	return strings.Join(ret, " ")
+}
+
+func decodeDecimalEscapes(s string) string {
+	// go-zonefile undoes \" and \\, but only the first \DDD in a run of
+	// them (so "h\195\169llo" comes to us as "h\xc3\169llo"), so finish
+	// the job.
+	ret := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isDigits(s[i+1:i+4]) {
+			if n, _ := strconv.Atoi(s[i+1 : i+4]); n <= 255 {
+				ret = append(ret, byte(n))
+				i += 3
+				continue
+			}
+		}
+		ret = append(ret, s[i])
+	}
+	return string(ret)
+}
+
+func splitTxtStrings(rdata string) []string {
+	// Split TXT rdata into its character-strings, honouring quotes and
+	// backslash escapes. Unquoted words are separate strings, as per RFC 1035.
+	ret := []string{}
+	cur := []byte{}
+	in_quotes := false
+	in_string := false
+	for i := 0; i < len(rdata); i++ {
+		c := rdata[i]
+		switch {
+		case c == '\\' && i+1 < len(rdata):
+			in_string = true
+			if i+3 < len(rdata) && isDigits(rdata[i+1:i+4]) {
+				// \DDD decimal escape.
+				n, _ := strconv.Atoi(rdata[i+1 : i+4])
+				cur = append(cur, byte(n))
+				i += 3
+			} else {
+				cur = append(cur, rdata[i+1])
+				i++
+			}
+		case c == '"':
+			if in_quotes || in_string {
+				ret = append(ret, string(cur))
+				cur = cur[:0]
+			}
+			in_quotes = !in_quotes
+			in_string = false
+		case !in_quotes && (c == ' ' || c == '\t'):
+			if in_string {
+				ret = append(ret, string(cur))
+				cur = cur[:0]
+				in_string = false
+			}
+		default:
+			cur = append(cur, c)
+			in_string = true
+		}
+	}
+	if in_string || in_quotes {
+		ret = append(ret, string(cur))
+	}
+	return ret
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeTxtRdata(rdata string) string {
+	// Always quote, and chunk anything over 255 bytes the way it goes on the wire.
+	ret := []string{}
+	for _, s := range splitTxtStrings(rdata) {
+		for len(s) > maxTxtStringLen {
+			ret = append(ret, quoteTxtString(s[:maxTxtStringLen]))
+			s = s[maxTxtStringLen:]
+		}
+		ret = append(ret, quoteTxtString(s))
+	}
+	return strings.Join(ret, " ")
+}
+
+func normalizeCaaRdata(rdata string) string {
+	// <flags> <tag> "<value>", with numeric flags and a lowercase tag.
+	fields := strings.SplitN(strings.TrimSpace(rdata), " ", 3)
+	if len(fields) != 3 {
+		return rdata
+	}
+	flags, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return rdata
+	}
+	value := strings.Join(splitTxtStrings(strings.TrimSpace(fields[2])), "")
+	return fmt.Sprintf("%d %s %s", flags, strings.ToLower(fields[1]), quoteTxtString(value))
+}
+
+func normalizeName(name string) string {
+	// DNS names are case-insensitive, and Cloud DNS always has the trailing dot.
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	return name
+}
+
+func normalizeRdata(rtype string, rdata string) string {
+	// Put a single rdata into a canonical form, so that equivalent answers
+	// written differently compare equal.
+	switch rtype {
+	case "A":
+		if ip := net.ParseIP(strings.TrimSpace(rdata)); ip != nil && ip.To4() != nil {
+			return ip.To4().String()
+		}
+		return rdata
+	case "AAAA":
+		if ip := net.ParseIP(strings.TrimSpace(rdata)); ip != nil {
+			return ip.String()
+		}
+		return rdata
+	case "TXT", "SPF":
+		return normalizeTxtRdata(rdata)
+	case "CAA":
+		return normalizeCaaRdata(rdata)
+	}
+
+	name_fields, ok := rdataNameFields[rtype]
+	if !ok {
+		return rdata
+	}
+	fields := strings.Fields(rdata)
+	for _, i := range name_fields {
+		if i < len(fields) {
+			fields[i] = normalizeName(fields[i])
+		}
+	}
+	// Leading numeric fields (MX preference, SRV priority etc.) lose any zero padding.
+	for i := range fields {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			break
+		}
+		fields[i] = strconv.Itoa(n)
+	}
+	return strings.Join(fields, " ")
+}
+
+func normalizeRrset(rr *dns.ResourceRecordSet) *dns.ResourceRecordSet {
+	// Return a copy of rr with its name and rdata in canonical form.
+	ret := *rr
+	ret.Name = normalizeName(rr.Name)
+	ret.Type = strings.ToUpper(rr.Type)
+	ret.Rrdatas = []string{}
+	for _, rd := range rr.Rrdatas {
+		ret.Rrdatas = append(ret.Rrdatas, normalizeRdata(ret.Type, rd))
+	}
+	if rr.Rrdatas == nil {
+		ret.Rrdatas = nil
+	}
+	return &ret
+}
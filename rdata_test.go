@@ -0,0 +1,232 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_qualifyRdata(t *testing.T) {
+	origin := "example.com."
+	type args struct {
+		rtype string
+		rdata string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "ARecordUntouched",
+			args: args{rtype: "A", rdata: "1.2.3.4"},
+			want: "1.2.3.4",
+		},
+		{
+			name: "TXTUntouched",
+			args: args{rtype: "TXT", rdata: `"some host"`},
+			want: `"some host"`,
+		},
+		{
+			name: "RelativeCNAME",
+			args: args{rtype: "CNAME", rdata: "www"},
+			want: "www.example.com.",
+		},
+		{
+			name: "AbsoluteCNAME",
+			args: args{rtype: "CNAME", rdata: "www.example.org."},
+			want: "www.example.org.",
+		},
+		{
+			name: "ApexCNAME",
+			args: args{rtype: "CNAME", rdata: "@"},
+			want: "example.com.",
+		},
+		{
+			name: "RelativeMX",
+			args: args{rtype: "MX", rdata: "10 mail"},
+			want: "10 mail.example.com.",
+		},
+		{
+			name: "AbsoluteMX",
+			args: args{rtype: "MX", rdata: "10 mail.example.org."},
+			want: "10 mail.example.org.",
+		},
+		{
+			name: "RelativeNS",
+			args: args{rtype: "NS", rdata: "ns1.sub"},
+			want: "ns1.sub.example.com.",
+		},
+		{
+			name: "RelativeSRV",
+			args: args{rtype: "SRV", rdata: "10 20 5060 sip"},
+			want: "10 20 5060 sip.example.com.",
+		},
+		{
+			name: "RelativePTR",
+			args: args{rtype: "PTR", rdata: "host"},
+			want: "host.example.com.",
+		},
+		{
+			name: "RelativeDNAME",
+			args: args{rtype: "DNAME", rdata: "other"},
+			want: "other.example.com.",
+		},
+		{
+			name: "RelativeSVCB",
+			args: args{rtype: "SVCB", rdata: "1 svc alpn=h2"},
+			want: "1 svc.example.com. alpn=h2",
+		},
+		{
+			name: "HTTPSSelfTarget",
+			args: args{rtype: "HTTPS", rdata: "1 . alpn=h3"},
+			want: "1 . alpn=h3",
+		},
+		{
+			name: "RelativeHTTPS",
+			args: args{rtype: "HTTPS", rdata: "1 cdn alpn=h3"},
+			want: "1 cdn.example.com. alpn=h3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := qualifyRdata(tt.args.rtype, tt.args.rdata, origin); got != tt.want {
+				t.Errorf("qualifyRdata() = '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_rdataFromZoneValues(t *testing.T) {
+	type args struct {
+		rtype  string
+		values []string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "MX",
+			args: args{rtype: "MX", values: []string{"10", "mail"}},
+			want: "10 mail",
+		},
+		{
+			name: "TXTSingle",
+			args: args{rtype: "TXT", values: []string{"v=spf1 -all"}},
+			want: `"v=spf1 -all"`,
+		},
+		{
+			name: "TXTMultipleWithQuotes",
+			args: args{rtype: "TXT", values: []string{"a", `say "hi"`}},
+			want: `"a" "say \"hi\""`,
+		},
+		{
+			// go-zonefile's take on "h\195\169llo".
+			name: "TXTDecimalEscapes",
+			args: args{rtype: "TXT", values: []string{"h\xc3\\169llo"}},
+			want: `"h\195\169llo"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := [][]byte{}
+			for _, v := range tt.args.values {
+				values = append(values, []byte(v))
+			}
+			if got := rdataFromZoneValues(tt.args.rtype, values); got != tt.want {
+				t.Errorf("rdataFromZoneValues() = '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_normalizeRdata(t *testing.T) {
+	type args struct {
+		rtype string
+		rdata string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "SimpleA",
+			args: args{rtype: "A", rdata: "1.2.3.4"},
+			want: "1.2.3.4",
+		},
+		{
+			name: "CanonicalIPv6",
+			args: args{rtype: "AAAA", rdata: "0:0::1"},
+			want: "::1",
+		},
+		{
+			name: "IPv6Case",
+			args: args{rtype: "AAAA", rdata: "2001:DB8::0001"},
+			want: "2001:db8::1",
+		},
+		{
+			name: "NotAnIP",
+			args: args{rtype: "A", rdata: "doot"},
+			want: "doot",
+		},
+		{
+			name: "CNAMECaseAndDot",
+			args: args{rtype: "CNAME", rdata: "WWW.Example.COM"},
+			want: "www.example.com.",
+		},
+		{
+			name: "MXPreferenceAndName",
+			args: args{rtype: "MX", rdata: "010  Mail.example.com."},
+			want: "10 mail.example.com.",
+		},
+		{
+			name: "SRV",
+			args: args{rtype: "SRV", rdata: "10 20 5060 SIP.example.com"},
+			want: "10 20 5060 sip.example.com.",
+		},
+		{
+			name: "UnquotedTXT",
+			args: args{rtype: "TXT", rdata: "v=spf1"},
+			want: `"v=spf1"`,
+		},
+		{
+			name: "UnquotedTXTWords",
+			args: args{rtype: "TXT", rdata: "hello world"},
+			want: `"hello" "world"`,
+		},
+		{
+			name: "QuotedTXTWithEscapes",
+			args: args{rtype: "TXT", rdata: `"say \"hi\"" "a\059b"`},
+			want: `"say \"hi\"" "a;b"`,
+		},
+		{
+			name: "EmptyTXT",
+			args: args{rtype: "TXT", rdata: `""`},
+			want: `""`,
+		},
+		{
+			name: "LongTXTChunked",
+			args: args{rtype: "TXT", rdata: `"` + strings.Repeat("a", 300) + `"`},
+			want: `"` + strings.Repeat("a", 255) + `" "` + strings.Repeat("a", 45) + `"`,
+		},
+		{
+			name: "CAAUnquoted",
+			args: args{rtype: "CAA", rdata: "0 ISSUE letsencrypt.org"},
+			want: `0 issue "letsencrypt.org"`,
+		},
+		{
+			name: "CAAQuoted",
+			args: args{rtype: "CAA", rdata: `128 iodef "mailto:x@example.com"`},
+			want: `128 iodef "mailto:x@example.com"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeRdata(tt.args.rtype, tt.args.rdata); got != tt.want {
+				t.Errorf("normalizeRdata() = '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Backoff between attempts at a change. Doubles up to changeRetryMax.
+var (
+	changeRetryInterval = time.Second
+	changeRetryMax      = 30 * time.Second
+)
+
+func retryReason(err error) string {
+	// Why err is worth another go, or "" if it isn't.
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch {
+		case gerr.Code == http.StatusConflict || gerr.Code == http.StatusPreconditionFailed:
+			// Someone else changed the zone under us.
+			return "conflict"
+		case gerr.Code == http.StatusTooManyRequests:
+			return "rate_limited"
+		case gerr.Code >= 500:
+			return "server_error"
+		}
+		return ""
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return "network"
+	}
+	return ""
+}
+
+func backoffDelay(base time.Duration, max time.Duration, attempt int) time.Duration {
+	// Exponential backoff from base up to max, with up to 50% jitter.
+	d := base
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	d = min(d, max)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func syncCloudDns(dnsSpec *CloudDNSSpec, build func() (*dns.Change, error)) error {
+	// Build a change against the zone as it is now and make it. If the zone
+	// changes under us or Cloud DNS has a wobble, re-read it, rebuild the
+	// change and try again, up to --max-retries times.
+	maxRetries := 0
+	if dnsSpec.max_retries != nil {
+		maxRetries = *dnsSpec.max_retries
+	}
+	verb := ""
+	if dnsSpec.source != nil {
+		verb = *dnsSpec.source
+	}
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		change, err := build()
+		if err == nil {
+			err = processCloudDnsChange(dnsSpec, change)
+		}
+		if err == nil {
+			dnsSyncSeconds.WithLabelValues(zoneLabel(dnsSpec), verb, "success").Observe(time.Since(start).Seconds())
+			return nil
+		}
+
+		reason := retryReason(err)
+		if reason == "" || attempt >= maxRetries {
+			dnsSyncSeconds.WithLabelValues(zoneLabel(dnsSpec), verb, "failure").Observe(time.Since(start).Seconds())
+			return err
+		}
+		dnsChangeRetries.WithLabelValues(zoneLabel(dnsSpec), reason).Inc()
+		delay := backoffDelay(changeRetryInterval, changeRetryMax, attempt)
+		log.Printf("Retrying in %s (%s, attempt %d of %d): %s", delay.Round(time.Millisecond), reason, attempt+1, maxRetries, err)
+		time.Sleep(delay)
+	}
+}
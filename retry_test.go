@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func Test_retryReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&googleapi.Error{Code: 409}, "conflict"},
+		{&googleapi.Error{Code: 412}, "conflict"},
+		{fmt.Errorf("wrapped: %w", &googleapi.Error{Code: 429}), "rate_limited"},
+		{&googleapi.Error{Code: 503}, "server_error"},
+		{&googleapi.Error{Code: 400}, ""},
+		{&googleapi.Error{Code: 403}, ""},
+		{errors.New("zonefile is broken"), ""},
+	}
+	for _, tt := range tests {
+		if got := retryReason(tt.err); got != tt.want {
+			t.Errorf("retryReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func Test_syncCloudDnsRetries(t *testing.T) {
+	// Cloud DNS says the first change conflicts, and takes the second.
+	var creates atomic.Int32
+	testDnsSpec := newTestCloudDnsSpec(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || !strings.HasSuffix(r.URL.Path, "/projects/myproject/managedZones/myzone/changes") {
+			http.NotFound(w, r)
+			return
+		}
+		if creates.Add(1) == 1 {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`{"error": {"code": 412, "message": "conditionNotMet"}}`))
+			return
+		}
+		change := &dns.Change{}
+		json.NewDecoder(r.Body).Decode(change)
+		change.Id = "1"
+		change.Status = "done"
+		json.NewEncoder(w).Encode(change)
+	}))
+	retries := 2
+	testDnsSpec.max_retries = &retries
+
+	orig := changeRetryInterval
+	changeRetryInterval = time.Millisecond
+	t.Cleanup(func() { changeRetryInterval = orig })
+	builds := 0
+	err := syncCloudDns(testDnsSpec, func() (*dns.Change, error) {
+		builds++
+		return &dns.Change{Additions: []*dns.ResourceRecordSet{
+			{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4"}},
+		}}, nil
+	})
+	if err != nil {
+		t.Errorf("syncCloudDns() error = %v", err)
+	}
+	if builds != 2 || creates.Load() != 2 {
+		t.Errorf("syncCloudDns() built %d and sent %d changes, want 2 and 2", builds, creates.Load())
+	}
+
+	// Non-retryable errors give up straight away.
+	builds = 0
+	err = syncCloudDns(testDnsSpec, func() (*dns.Change, error) {
+		builds++
+		return nil, errors.New("zonefile is broken")
+	})
+	if err == nil || builds != 1 {
+		t.Errorf("syncCloudDns() = %v after %d builds, want an error after 1", err, builds)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func countManagedRrsets(rrs []*dns.ResourceRecordSet) int {
+	// SOA and NS records are Cloud DNS's business, not ours.
+	ret := 0
+	for _, rr := range rrs {
+		if rr.Type != "SOA" && rr.Type != "NS" {
+			ret++
+		}
+	}
+	return ret
+}
+
+func checkChangeLimits(dnsSpec *CloudDNSSpec, change *dns.Change, cloud_rrs []*dns.ResourceRecordSet) (string, error) {
+	// Check change against the safety limits in dnsSpec, given the zone
+	// currently holds cloud_rrs. Returns the reason (for metrics) and an
+	// error if the change should be refused.
+	diffs := diffDnsChange(change)
+	added, modified, deleted := countDiffs(diffs)
+
+	if *dnsSpec.max_deletions >= 0 && deleted > *dnsSpec.max_deletions {
+		return "max_deletions", fmt.Errorf("change deletes %d rrsets, more than --max-deletions=%d",
+			deleted, *dnsSpec.max_deletions)
+	}
+
+	current := countManagedRrsets(cloud_rrs)
+
+	if *dnsSpec.max_change_percent >= 0 && current > 0 {
+		percent := (added + modified + deleted) * 100 / current
+		if percent > *dnsSpec.max_change_percent {
+			return "max_change_percent", fmt.Errorf("change touches %d%% of %d rrsets, more than --max-change-percent=%d",
+				percent, current, *dnsSpec.max_change_percent)
+		}
+	}
+
+	if !*dnsSpec.allow_empty_zone && current > 0 {
+		after := current + countManagedRrsets(change.Additions) - countManagedRrsets(change.Deletions)
+		if after <= 0 {
+			return "empty_zone", fmt.Errorf("change would remove all %d rrsets from the zone, use --allow-empty-zone if you really mean it",
+				current)
+		}
+	}
+
+	return "", nil
+}
+
+func enforceChangeLimits(dnsSpec *CloudDNSSpec, change *dns.Change) error {
+	// Nothing to check if no limits are set.
+	if *dnsSpec.max_deletions < 0 && *dnsSpec.max_change_percent < 0 && *dnsSpec.allow_empty_zone {
+		return nil
+	}
+
+	// Only list the zone if a limit that needs its size could trip. A change
+	// can only empty the zone if it deletes more than it adds, which most
+	// (like a dynrecord update) don't.
+	net_deletions := countManagedRrsets(change.Deletions) - countManagedRrsets(change.Additions)
+	var cloud_rrs []*dns.ResourceRecordSet
+	if *dnsSpec.max_change_percent >= 0 || (!*dnsSpec.allow_empty_zone && net_deletions > 0) {
+		var err error
+		cloud_rrs, err = getResourceRecordSetsForZone(dnsSpec)
+		if err != nil {
+			log.Print("Getting RRs for zone:", *dnsSpec.zone)
+			return err
+		}
+	}
+
+	reason, err := checkChangeLimits(dnsSpec, change, cloud_rrs)
+	if err != nil {
+		dnsChangesBlocked.WithLabelValues(*dnsSpec.zone, reason).Inc()
+	}
+	return err
+}
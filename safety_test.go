@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/dns/v1"
+)
+
+func Test_checkChangeLimits(t *testing.T) {
+	cloud_rrs := []*dns.ResourceRecordSet{
+		{Name: "mydomain.test.", Type: "SOA", Ttl: 21600, Rrdatas: []string{"ns1.example.com. root.example.com. 1 2 3 4 5"}},
+		{Name: "mydomain.test.", Type: "NS", Ttl: 21600, Rrdatas: []string{"ns1.example.com."}},
+		{Name: "a.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}},
+		{Name: "b.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"2.2.2.2"}},
+		{Name: "c.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"3.3.3.3"}},
+		{Name: "d.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"4.4.4.4"}},
+	}
+
+	deleteOne := &dns.Change{Deletions: cloud_rrs[2:3]}
+	deleteAll := &dns.Change{Deletions: cloud_rrs[2:]}
+	modifyTwo := &dns.Change{
+		Additions: []*dns.ResourceRecordSet{
+			{Name: "a.mydomain.test.", Type: "A", Ttl: 60, Rrdatas: []string{"1.1.1.1"}},
+			{Name: "b.mydomain.test.", Type: "A", Ttl: 60, Rrdatas: []string{"2.2.2.2"}},
+		},
+		Deletions: cloud_rrs[2:4],
+	}
+
+	tests := []struct {
+		name             string
+		maxDeletions     int
+		maxChangePercent int
+		allowEmptyZone   bool
+		change           *dns.Change
+		wantReason       string
+	}{
+		{"no limits", -1, -1, true, deleteAll, ""},
+		{"empty zone refused", -1, -1, false, deleteAll, "empty_zone"},
+		{"under max deletions", 1, -1, false, deleteOne, ""},
+		{"over max deletions", 0, -1, false, deleteOne, "max_deletions"},
+		{"modifications aren't deletions", 0, -1, false, modifyTwo, ""},
+		{"under max percent", -1, 50, false, modifyTwo, ""},
+		{"over max percent", -1, 49, false, modifyTwo, "max_change_percent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDnsSpec := &CloudDNSSpec{
+				max_deletions:      &tt.maxDeletions,
+				max_change_percent: &tt.maxChangePercent,
+				allow_empty_zone:   &tt.allowEmptyZone,
+			}
+			reason, err := checkChangeLimits(testDnsSpec, tt.change, cloud_rrs)
+			if reason != tt.wantReason {
+				t.Errorf("checkChangeLimits() reason = %q, want %q", reason, tt.wantReason)
+			}
+			if (err != nil) != (tt.wantReason != "") {
+				t.Errorf("checkChangeLimits() error = %v, want reason %q", err, tt.wantReason)
+			}
+		})
+	}
+}
+
+func Test_enforceChangeLimitsListsOnlyWhenNeeded(t *testing.T) {
+	cloud_rrs := []*dns.ResourceRecordSet{
+		{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}},
+	}
+	replace := &dns.Change{
+		Additions: []*dns.ResourceRecordSet{{Name: "home.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"2.2.2.2"}}},
+		Deletions: cloud_rrs,
+	}
+	deleteOnly := &dns.Change{Deletions: cloud_rrs}
+
+	tests := []struct {
+		name             string
+		maxChangePercent int
+		change           *dns.Change
+		wantLists        float64
+		wantErr          bool
+	}{
+		{"replacing one record", -1, replace, 0, false},
+		{"deleting could empty the zone", -1, deleteOnly, 1, true},
+		{"percent limit needs the zone size", 100, replace, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDnsSpec, _ := newFakeCloudDnsSpec(t, cloud_rrs)
+			no_empty := false
+			testDnsSpec.allow_empty_zone = &no_empty
+			testDnsSpec.max_change_percent = &tt.maxChangePercent
+
+			lists := dnsApiCalls.WithLabelValues("myzone", "ResourceRecordSets.List")
+			before := testutil.ToFloat64(lists)
+			err := enforceChangeLimits(testDnsSpec, tt.change)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("enforceChangeLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := testutil.ToFloat64(lists) - before; got != tt.wantLists {
+				t.Errorf("enforceChangeLimits() listed the zone %v times, want %v", got, tt.wantLists)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+// Somewhere to keep copies of the zone from before each change.
+type snapshotStore interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	// Names of all snapshots starting with prefix, oldest first.
+	List(prefix string) ([]string, error)
+	Delete(name string) error
+}
+
+// Snapshots as files in a local directory.
+type dirSnapshotStore struct {
+	dir string
+}
+
+func (s *dirSnapshotStore) Put(name string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath.Join(s.dir, name), data)
+}
+
+func (s *dirSnapshotStore) Get(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, name))
+}
+
+func (s *dirSnapshotStore) List(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	ret := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), prefix) {
+			ret = append(ret, e.Name())
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (s *dirSnapshotStore) Delete(name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+// Snapshots as objects in a GCS bucket, under an optional prefix.
+type gcsSnapshotStore struct {
+	svc    *storage.Service
+	bucket string
+	prefix string
+}
+
+func (s *gcsSnapshotStore) Put(name string, data []byte) error {
+	obj := &storage.Object{Name: s.prefix + name, ContentType: "application/json"}
+	_, err := s.svc.Objects.Insert(s.bucket, obj).Media(bytes.NewReader(data)).Do()
+	return err
+}
+
+func (s *gcsSnapshotStore) Get(name string) ([]byte, error) {
+	res, err := s.svc.Objects.Get(s.bucket, s.prefix+name).Download()
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
+
+func (s *gcsSnapshotStore) List(prefix string) ([]string, error) {
+	ret := []string{}
+	err := s.svc.Objects.List(s.bucket).Prefix(s.prefix+prefix).Pages(context.Background(), func(objs *storage.Objects) error {
+		for _, o := range objs.Items {
+			ret = append(ret, strings.TrimPrefix(o.Name, s.prefix))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (s *gcsSnapshotStore) Delete(name string) error {
+	return s.svc.Objects.Delete(s.bucket, s.prefix+name).Do()
+}
+
+func newSnapshotStore(ctx context.Context, location string, opts ...option.ClientOption) (snapshotStore, error) {
+	// gs://bucket/some/prefix for GCS, anything else is a local directory.
+	if !strings.HasPrefix(location, "gs://") {
+		return &dirSnapshotStore{dir: location}, nil
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "gs://"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket in %s", location)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	svc, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsSnapshotStore{svc: svc, bucket: bucket, prefix: prefix}, nil
+}
+
+const snapshotTimeFormat = "20060102T150405.000Z"
+
+func snapshotName(zone string, t time.Time) string {
+	// Sorts in time order, so List() gives oldest first.
+	return fmt.Sprintf("%s-%s.json", zone, t.UTC().Format(snapshotTimeFormat))
+}
+
+func zoneSnapshots(store snapshotStore, zone string) ([]string, error) {
+	// Names of zone's snapshots, oldest first. Only exactly zone-<time>.json,
+	// so "myzone" doesn't pick up "myzone-staging"'s snapshots.
+	names, err := store.List(zone + "-")
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, n := range names {
+		ts, ok := strings.CutSuffix(strings.TrimPrefix(n, zone+"-"), ".json")
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(snapshotTimeFormat, ts); err != nil {
+			continue
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+func pruneSnapshots(store snapshotStore, zone string, keep int) error {
+	// Keep only the newest keep snapshots of zone. 0 keeps everything.
+	if keep <= 0 {
+		return nil
+	}
+	names, err := zoneSnapshots(store, zone)
+	if err != nil {
+		return err
+	}
+	for len(names) > keep {
+		log.Printf("Removing old snapshot %s", names[0])
+		if err := store.Delete(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+func saveSnapshot(dnsSpec *CloudDNSSpec, rrs []*dns.ResourceRecordSet, now time.Time) (string, error) {
+	data, err := renderZone(dnsSpec, rrs, "json")
+	if err != nil {
+		return "", err
+	}
+	name := snapshotName(*dnsSpec.zone, now)
+	if err := dnsSpec.snapshots.Put(name, []byte(data)); err != nil {
+		return "", err
+	}
+	log.Printf("Saved snapshot %s of %d rrsets", name, len(rrs))
+	return name, pruneSnapshots(dnsSpec.snapshots, *dnsSpec.zone, *dnsSpec.snapshot_retention)
+}
+
+func snapshotZone(dnsSpec *CloudDNSSpec) error {
+	// Snapshot the zone as it is right now, if we've somewhere to put it.
+	if dnsSpec.snapshots == nil {
+		return nil
+	}
+	cloud_rrs, err := getResourceRecordSetsForZone(dnsSpec)
+	if err != nil {
+		log.Print("Getting RRs for zone:", *dnsSpec.zone)
+		return err
+	}
+	_, err = saveSnapshot(dnsSpec, cloud_rrs, time.Now())
+	return err
+}
+
+func resolveSnapshotName(dnsSpec *CloudDNSSpec, name string) (string, error) {
+	// "latest" means the newest snapshot of this zone.
+	names, err := zoneSnapshots(dnsSpec.snapshots, *dnsSpec.zone)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no snapshots of zone %s", *dnsSpec.zone)
+	}
+	if name == "latest" {
+		return names[len(names)-1], nil
+	}
+	for _, n := range names {
+		if n == name {
+			return n, nil
+		}
+	}
+	return "", fmt.Errorf("no snapshot %s of zone %s", name, *dnsSpec.zone)
+}
+
+func listSnapshots(dnsSpec *CloudDNSSpec) error {
+	names, err := zoneSnapshots(dnsSpec.snapshots, *dnsSpec.zone)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		fmt.Println(n)
+	}
+	return nil
+}
+
+func restoreSnapshot(dnsSpec *CloudDNSSpec, name string) error {
+	// Make the zone look exactly like it did in the snapshot.
+	name, err := resolveSnapshotName(dnsSpec, name)
+	if err != nil {
+		return err
+	}
+	data, err := dnsSpec.snapshots.Get(name)
+	if err != nil {
+		return err
+	}
+	snap_rrs, _, err := loadZoneRrsets(dnsSpec, data, "json")
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	log.Printf("Restoring zone %s to snapshot %s", *dnsSpec.zone, name)
+	return syncCloudDns(dnsSpec, func() (*dns.Change, error) {
+		cloud_rrs, err := getResourceRecordSetsForZone(dnsSpec)
+		if err != nil {
+			log.Print("Getting RRs for zone:", *dnsSpec.zone)
+			return nil, err
+		}
+		change := buildDnsChange(cloud_rrs, snap_rrs, true, *dnsSpec.domain)
+		recordDrift(dnsSpec, snap_rrs, cloud_rrs, change)
+		return change, nil
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func Test_saveSnapshot(t *testing.T) {
+	test_domain := "mydomain.test."
+	test_zone := "myzone"
+	default_ttl := 300
+	retention := 2
+	testDnsSpec := &CloudDNSSpec{
+		zone:               &test_zone,
+		domain:             &test_domain,
+		default_ttl:        &default_ttl,
+		snapshots:          &dirSnapshotStore{dir: t.TempDir() + "/snapshots"},
+		snapshot_retention: &retention,
+	}
+
+	cloud_rrs := []*dns.ResourceRecordSet{
+		{Name: "mydomain.test.", Type: "SOA", Ttl: 21600, Rrdatas: []string{"ns1.example.com. root.example.com. 1 2 3 4 5"}},
+		{Name: "mydomain.test.", Type: "NS", Ttl: 21600, Rrdatas: []string{"ns1.example.com."}},
+		{Name: "www.mydomain.test.", Type: "A", Ttl: 300, Rrdatas: []string{"1.2.3.4"}},
+		{Name: "mydomain.test.", Type: "MX", Ttl: 3600, Rrdatas: []string{"10 mail.mydomain.test."}},
+	}
+
+	// Other zones' snapshots in the same place are left alone, even when
+	// their names start with ours.
+	for _, name := range []string{"otherzone-20200101T000000.000Z.json", "myzone-staging-20200101T000000.000Z.json", "myzone-staging-20300101T000000.000Z.json"} {
+		if err := testDnsSpec.snapshots.Put(name, []byte("[]")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	names := []string{}
+	for i := 0; i < 3; i++ {
+		name, err := saveSnapshot(testDnsSpec, cloud_rrs, start.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatalf("saveSnapshot() error = %v", err)
+		}
+		names = append(names, name)
+	}
+
+	got, err := zoneSnapshots(testDnsSpec.snapshots, "myzone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != names[1] || got[1] != names[2] {
+		t.Errorf("snapshots after retention = %v, want %v", got, names[1:])
+	}
+	if other, _ := testDnsSpec.snapshots.List("otherzone-"); len(other) != 1 {
+		t.Errorf("other zone's snapshots = %v, want 1", other)
+	}
+	if staging, _ := zoneSnapshots(testDnsSpec.snapshots, "myzone-staging"); len(staging) != 2 {
+		t.Errorf("myzone-staging's snapshots = %v, want 2", staging)
+	}
+
+	latest, err := resolveSnapshotName(testDnsSpec, "latest")
+	if err != nil || latest != names[2] {
+		t.Errorf("resolveSnapshotName(latest) = %v, %v, want %v", latest, err, names[2])
+	}
+	if _, err := resolveSnapshotName(testDnsSpec, names[0]); err == nil {
+		t.Errorf("resolveSnapshotName() found pruned snapshot %s", names[0])
+	}
+	if _, err := resolveSnapshotName(testDnsSpec, "myzone-staging-20300101T000000.000Z.json"); err == nil {
+		t.Errorf("resolveSnapshotName() found another zone's snapshot")
+	}
+
+	// Restoring the snapshot over the zone it was taken from is a no-op.
+	data, err := testDnsSpec.snapshots.Get(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap_rrs, _, err := loadZoneRrsets(testDnsSpec, data, "json")
+	if err != nil {
+		t.Fatalf("loadZoneRrsets() error = %v", err)
+	}
+	change := buildDnsChange(cloud_rrs, snap_rrs, true, *testDnsSpec.domain)
+	if len(change.Additions) != 0 || len(change.Deletions) != 0 {
+		t.Errorf("restoring an unchanged zone gives %d additions and %d deletions",
+			len(change.Additions), len(change.Deletions))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What /status shows.
+type syncStatus struct {
+	LastAttempt         *time.Time        `json:"lastAttempt,omitempty"`
+	LastSuccess         *time.Time        `json:"lastSuccess,omitempty"`
+	LastError           string            `json:"lastError,omitempty"`
+	ConsecutiveFailures int               `json:"consecutiveFailures"`
+	DesiredRrsets       int               `json:"desiredRrsets"`
+	ActualRrsets        int               `json:"actualRrsets"`
+	LastChange          *syncStatusChange `json:"lastChange,omitempty"`
+	// Each job's addresses, as of the last successful sync.
+	Jobs map[string][]string `json:"jobs,omitempty"`
+}
+
+type syncStatusChange struct {
+	Id        string `json:"id"`
+	StartTime string `json:"startTime,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+func (s *nomadSyncState) status() syncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := syncStatus{
+		ConsecutiveFailures: s.consecutiveFailures,
+		DesiredRrsets:       s.desiredRrsets,
+		ActualRrsets:        s.actualRrsets,
+	}
+	if !s.lastAttempt.IsZero() {
+		t := s.lastAttempt.UTC()
+		ret.LastAttempt = &t
+	}
+	if !s.lastSuccess.IsZero() {
+		t := s.lastSuccess.UTC()
+		ret.LastSuccess = &t
+	}
+	if s.lastError != nil {
+		ret.LastError = s.lastError.Error()
+	}
+	if len(s.tasks) > 0 {
+		ret.Jobs = map[string][]string{}
+		for _, t := range s.tasks {
+			ret.Jobs[t.jobid] = append(ret.Jobs[t.jobid], t.ip)
+		}
+	}
+	if s.lastChange != nil {
+		ret.LastChange = &syncStatusChange{
+			Id:        s.lastChange.Id,
+			StartTime: s.lastChange.StartTime,
+			Status:    s.lastChange.Status,
+			Additions: len(s.lastChange.Additions),
+			Deletions: len(s.lastChange.Deletions),
+		}
+	}
+	return ret
+}
+
+func (s *nomadSyncState) readiness(maxAge time.Duration) error {
+	// Ready once we've synced successfully, and as long as it wasn't too long
+	// ago. maxAge of 0 means any successful sync will do.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastSuccess.IsZero() {
+		if s.lastError != nil {
+			return fmt.Errorf("no successful sync yet, last error: %s", s.lastError)
+		}
+		return fmt.Errorf("no successful sync yet")
+	}
+	if maxAge > 0 && time.Since(s.lastSuccess) > maxAge {
+		return fmt.Errorf("last successful sync was %s ago", time.Since(s.lastSuccess).Round(time.Second))
+	}
+	return nil
+}
+
+func registerStatusHandlers(mux *http.ServeMux, state *nomadSyncState, maxAge time.Duration, checks map[string]func() error) {
+	// /healthz: we're up. /readyz: we're syncing and can reach what we sync
+	// between. /status: the details.
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		problems := []string{}
+		if err := state.readiness(maxAge); err != nil {
+			problems = append(problems, "sync: "+err.Error())
+		}
+		names := []string{}
+		for name := range checks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := checks[name](); err != nil {
+				problems = append(problems, name+": "+err.Error())
+			}
+		}
+		if len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		data, err := json.MarshalIndent(state.status(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(append(data, '\n'))
+	})
+}
+
+func cloudDnsReachable(dnsSpec *CloudDNSSpec) func() error {
+	return func() error {
+		_, err := dnsSpec.svc.ManagedZones.Get(*dnsSpec.project, *dnsSpec.zone).Fields("name").Do()
+		countApiCall(dnsSpec, "ManagedZones.Get", err)
+		return err
+	}
+}
+
+func nomadReachable(nomadSpec *NomadSpec) func() error {
+	return func() error {
+		c, err := nomadClient(nomadSpec)
+		if err != nil {
+			return err
+		}
+		_, err = c.Status().Leader()
+		return err
+	}
+}
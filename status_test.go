@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func Test_statusHandlers(t *testing.T) {
+	state := &nomadSyncState{}
+	nomadErr := errors.New("no leader")
+	checks := map[string]func() error{
+		"cloud dns": func() error { return nil },
+		"nomad":     func() error { return nomadErr },
+	}
+	mux := http.NewServeMux()
+	registerStatusHandlers(mux, state, time.Minute, checks)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	if w := get("/healthz"); w.Code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", w.Code)
+	}
+
+	// Not ready before the first sync, or while nomad is unreachable.
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before first sync = %d, want 503", w.Code)
+	}
+	state.recordSync([]TaskInfo{{jobid: "myjob", ip: "1.2.3.4"}, {jobid: "myjob", ip: "5.6.7.8"}}, nil)
+	state.recordCounts([]TaskInfo{{jobid: "myjob", ip: "1.2.3.4"}, {jobid: "myjob", ip: "5.6.7.8"}}, 3)
+	state.recordChange(&dns.Change{Id: "7", Status: "done", Additions: []*dns.ResourceRecordSet{{}}})
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz with nomad down = %d, want 503", w.Code)
+	}
+	nomadErr = nil
+	if w := get("/readyz"); w.Code != http.StatusOK {
+		t.Errorf("/readyz = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	// A failed sync doesn't make us unready until the last success is too old.
+	state.recordSync(nil, errors.New("nomad is down"))
+	if w := get("/readyz"); w.Code != http.StatusOK {
+		t.Errorf("/readyz after one failure = %d, want 200", w.Code)
+	}
+	state.mu.Lock()
+	state.lastSuccess = time.Now().Add(-2 * time.Minute)
+	state.mu.Unlock()
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz with a stale sync = %d, want 503", w.Code)
+	}
+
+	w := get("/status")
+	got := syncStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("/status isn't JSON: %s: %s", err, w.Body)
+	}
+	if got.LastSuccess == nil || got.LastError != "nomad is down" || got.ConsecutiveFailures != 1 {
+		t.Errorf("/status sync state = %s", w.Body)
+	}
+	if got.DesiredRrsets != 1 || got.ActualRrsets != 3 {
+		t.Errorf("/status desired, actual = %d, %d, want 1, 3", got.DesiredRrsets, got.ActualRrsets)
+	}
+	if ips := got.Jobs["myjob"]; len(got.Jobs) != 1 || len(ips) != 2 || ips[0] != "1.2.3.4" || ips[1] != "5.6.7.8" {
+		t.Errorf("/status jobs = %v, want myjob at 1.2.3.4 and 5.6.7.8", got.Jobs)
+	}
+	if got.LastChange == nil || got.LastChange.Id != "7" || got.LastChange.Additions != 1 {
+		t.Errorf("/status last change = %+v", got.LastChange)
+	}
+}
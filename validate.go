@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func nameInZone(name string, domain string) bool {
+	name = normalizeName(name)
+	domain = normalizeName(domain)
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+func validateZoneRrsets(domain string, rrs []*dns.ResourceRecordSet) []string {
+	// Semantic checks on a set of rrsets destined for the zone 'domain'.
+	// Returns a list of human-readable problems, empty if all is well.
+	problems := []string{}
+
+	cnames := map[string]bool{}
+	for _, rr := range rrs {
+		if rr.Type == "CNAME" {
+			cnames[normalizeName(rr.Name)] = true
+		}
+	}
+
+	for _, rr := range rrs {
+		desc := fmt.Sprintf("%s (%s)", rr.Name, rr.Type)
+
+		if !nameInZone(rr.Name, domain) {
+			problems = append(problems, fmt.Sprintf("%s: name is outside zone %s", desc, domain))
+		}
+
+		switch rr.Type {
+		case "CNAME":
+			if normalizeName(rr.Name) == normalizeName(domain) {
+				problems = append(problems, fmt.Sprintf("%s: CNAME not allowed at the zone apex", desc))
+			}
+			if len(rr.Rrdatas) > 1 {
+				problems = append(problems, fmt.Sprintf("%s: CNAME has %d targets", desc, len(rr.Rrdatas)))
+			}
+			for _, other := range rrs {
+				if other.Type != "CNAME" && sameName(rr, other) {
+					problems = append(problems, fmt.Sprintf("%s: CNAME coexists with %s record", desc, other.Type))
+				}
+			}
+		case "A", "AAAA":
+			for _, rd := range rr.Rrdatas {
+				ip := net.ParseIP(rd)
+				if ip == nil ||
+					(rr.Type == "A" && ip.To4() == nil) ||
+					(rr.Type == "AAAA" && !strings.Contains(rd, ":")) {
+					problems = append(problems, fmt.Sprintf("%s: invalid address '%s'", desc, rd))
+				}
+			}
+		case "MX", "NS":
+			for _, rd := range rr.Rrdatas {
+				fields := strings.Fields(rd)
+				if len(fields) == 0 {
+					problems = append(problems, fmt.Sprintf("%s: empty rdata", desc))
+					continue
+				}
+				target := fields[len(fields)-1]
+				if cnames[normalizeName(target)] {
+					problems = append(problems, fmt.Sprintf("%s: target %s is a CNAME", desc, target))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+func sameName(x *dns.ResourceRecordSet, y *dns.ResourceRecordSet) bool {
+	return normalizeName(x.Name) == normalizeName(y.Name)
+}
+
+func validateZonefile(dnsSpec *CloudDNSSpec, zoneFilename *string, format *string) ([]string, error) {
+	// Parse the zonefile exactly as putzonefile would, and check the result.
+	data, err := os.ReadFile(*zoneFilename)
+	if err != nil {
+		log.Print("Error opening zonefile: ", *zoneFilename)
+		return nil, err
+	}
+
+	zone_rrs, problems, err := loadZoneRrsets(dnsSpec, data, *format)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(problems, validateZoneRrsets(*dnsSpec.domain, zone_rrs)...), nil
+}
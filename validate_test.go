@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/dns/v1"
+)
+
+func Test_validateZoneRrsets(t *testing.T) {
+	domain := "mydomain.test."
+	tests := []struct {
+		name string
+		rrs  []*dns.ResourceRecordSet
+		want []string
+	}{
+		{
+			name: "Empty",
+			rrs:  []*dns.ResourceRecordSet{},
+			want: []string{},
+		},
+		{
+			name: "AllGood",
+			rrs: []*dns.ResourceRecordSet{
+				{Name: "www.mydomain.test.", Type: "A", Rrdatas: []string{"1.2.3.4"}},
+				{Name: "www.mydomain.test.", Type: "AAAA", Rrdatas: []string{"2001:db8::1"}},
+				{Name: "ftp.mydomain.test.", Type: "CNAME", Rrdatas: []string{"www.mydomain.test."}},
+				{Name: "mydomain.test.", Type: "MX", Rrdatas: []string{"10 www.mydomain.test."}},
+			},
+			want: []string{},
+		},
+		{
+			name: "CNAMEWithOtherType",
+			rrs: []*dns.ResourceRecordSet{
+				{Name: "www.mydomain.test.", Type: "CNAME", Rrdatas: []string{"other.example.com."}},
+				{Name: "www.mydomain.test.", Type: "TXT", Rrdatas: []string{`"hi"`}},
+			},
+			want: []string{"www.mydomain.test. (CNAME): CNAME coexists with TXT record"},
+		},
+		{
+			name: "CNAMEAtApex",
+			rrs: []*dns.ResourceRecordSet{
+				{Name: "mydomain.test.", Type: "CNAME", Rrdatas: []string{"other.example.com."}},
+			},
+			want: []string{"mydomain.test. (CNAME): CNAME not allowed at the zone apex"},
+		},
+		{
+			name: "OutOfZone",
+			rrs: []*dns.ResourceRecordSet{
+				{Name: "www.otherdomain.test.", Type: "A", Rrdatas: []string{"1.2.3.4"}},
+				{Name: "notmydomain.test.", Type: "A", Rrdatas: []string{"1.2.3.4"}},
+			},
+			want: []string{
+				"www.otherdomain.test. (A): name is outside zone mydomain.test.",
+				"notmydomain.test. (A): name is outside zone mydomain.test.",
+			},
+		},
+		{
+			name: "InvalidIPs",
+			rrs: []*dns.ResourceRecordSet{
+				{Name: "a.mydomain.test.", Type: "A", Rrdatas: []string{"1.2.3.400", "2001:db8::1"}},
+				{Name: "b.mydomain.test.", Type: "AAAA", Rrdatas: []string{"1.2.3.4"}},
+			},
+			want: []string{
+				"a.mydomain.test. (A): invalid address '1.2.3.400'",
+				"a.mydomain.test. (A): invalid address '2001:db8::1'",
+				"b.mydomain.test. (AAAA): invalid address '1.2.3.4'",
+			},
+		},
+		{
+			name: "MXAndNSToCNAME",
+			rrs: []*dns.ResourceRecordSet{
+				{Name: "mail.mydomain.test.", Type: "CNAME", Rrdatas: []string{"mx.example.com."}},
+				{Name: "mydomain.test.", Type: "MX", Rrdatas: []string{"10 mail.mydomain.test."}},
+				{Name: "sub.mydomain.test.", Type: "NS", Rrdatas: []string{"Mail.mydomain.test."}},
+			},
+			want: []string{
+				"mydomain.test. (MX): target mail.mydomain.test. is a CNAME",
+				"sub.mydomain.test. (NS): target Mail.mydomain.test. is a CNAME",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateZoneRrsets(domain, tt.rrs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateZoneRrsets() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_loadZonefileRrsetsTtlConflict(t *testing.T) {
+	test_domain := "mydomain.test."
+	default_ttl := 300
+	testDnsSpec := &CloudDNSSpec{
+		default_ttl: &default_ttl,
+		domain:      &test_domain,
+	}
+
+	zone := `www 60 IN A 1.2.3.4
+www 60 IN A 1.2.3.5
+www IN A 5.6.7.8
+`
+	want := []string{"www.mydomain.test. (A): conflicting TTLs 60 and 300"}
+
+	_, got, err := loadZonefileRrsets(testDnsSpec, []byte(zone))
+	if err != nil {
+		t.Fatalf("loadZonefileRrsets() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadZonefileRrsets() problems = %q, want %q", got, want)
+	}
+}